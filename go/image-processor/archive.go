@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"strings"
+)
+
+// archivePrefix is where originals are archived byte for byte, from
+// --archive-prefix; empty disables the archive
+var archivePrefix string
+
+// archiveStore holds the archive, from --archive-bucket. It is never the image
+// bucket, which is publicly readable.
+var archiveStore ObjectStore
+
+// parseArchivePrefix validates --archive-prefix. Archive paths are recorded in
+// the cache, so they may not contain its separators.
+func parseArchivePrefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(prefix, "|=") {
+		return "", fmt.Errorf("archive prefix %q may not contain | or =", prefix)
+	}
+	return prefix, nil
+}
+
+// archiveOriginal stores the original blob of an image unchanged as
+// <archivePrefix>/<id>.<format> in the archive store, skipping an existing
+// object unless overwrite is set. It returns the object path, or "" if
+// archiving is disabled.
+//
+// Archived originals keep their full resolution and EXIF, GPS included, so
+// they go to a private bucket, are written with a private Cache-Control and
+// are never linked from the site.
+func archiveOriginal(ctx context.Context, id string, blob *imageBlob, overwrite bool, fl *fileLocker) (string, error) {
+	if archivePrefix == "" {
+		return "", nil
+	}
+
+	_, format, err := image.DecodeConfig(blob.Reader())
+	if err != nil {
+		return "", fmt.Errorf("decode failed: %w", err)
+	}
+	objectPath := fmt.Sprintf("%s/%s.%s", archivePrefix, id, format)
+
+	fl.Lock(objectPath)
+	defer fl.Unlock(objectPath)
+
+	if _, err := archiveStore.Stat(ctx, objectPath); err == nil && !overwrite {
+		slog.Debug("original already archived", "variant", objectPath)
+		return objectPath, nil
+	}
+
+	opts := WriteOptions{
+		ContentType:  "image/" + format,
+		CacheControl: "private, no-store",
+	}
+	if err := archiveStore.Write(ctx, objectPath, blob.Reader(), opts); err != nil {
+		return "", fmt.Errorf("archive failed for %s: %w", objectPath, err)
+	}
+	slog.Debug("original archived", "variant", objectPath, "bytes", blob.Size())
+	return objectPath, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// hostBreaker is shared by all downloads, with the threshold from --breaker-threshold
+var hostBreaker = newCircuitBreaker(5)
+
+var errCircuitOpen = errors.New("circuit open")
+
+// circuitBreaker fails downloads fast for hosts that keep failing. After
+// threshold consecutive retryable failures from a host it trips and stays
+// open for the rest of the run, so an outage costs a few retries rather than
+// several for every image. A threshold of 0 or less disables it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	hosts     map[string]*hostState
+}
+
+type hostState struct {
+	failures int // Consecutive, reset by a success
+	tripped  bool
+	rejected int // Downloads failed fast after tripping
+	lastErr  error
+}
+
+// TrippedHost describes a host whose breaker is open
+type TrippedHost struct {
+	Host     string
+	Rejected int
+	LastErr  error
+}
+
+func newCircuitBreaker(threshold int) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		hosts:     make(map[string]*hostState),
+	}
+}
+
+// Allow returns an error if downloads from the URL's host should fail fast
+func (b *circuitBreaker) Allow(rawURL string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	host := urlHost(rawURL)
+	state, ok := b.hosts[host]
+	if !ok || !state.tripped {
+		return nil
+	}
+	state.rejected++
+	return retryable(fmt.Errorf("%w for %s", errCircuitOpen, host))
+}
+
+// Record updates the host's state with the outcome of a download attempt.
+// Only retryable failures count; a 404 says nothing about the host's health.
+func (b *circuitBreaker) Record(rawURL string, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	host := urlHost(rawURL)
+	state, ok := b.hosts[host]
+	if !ok {
+		state = &hostState{}
+		b.hosts[host] = state
+	}
+
+	switch {
+	case err == nil:
+		state.failures = 0
+	case classifyError(err) == ErrorRetryable:
+		state.failures++
+		state.lastErr = err
+		if state.failures >= b.threshold && !state.tripped {
+			state.tripped = true
+			slog.Warn("circuit breaker tripped, failing fast for the rest of the run", "host", host, "failures", state.failures, "error", err)
+		}
+	}
+}
+
+// Tripped returns the hosts whose breaker is open, sorted by host
+func (b *circuitBreaker) Tripped() []TrippedHost {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var tripped []TrippedHost
+	for host, state := range b.hosts {
+		if state.tripped {
+			tripped = append(tripped, TrippedHost{Host: host, Rejected: state.rejected, LastErr: state.lastErr})
+		}
+	}
+	sort.Slice(tripped, func(i, j int) bool {
+		return tripped[i].Host < tripped[j].Host
+	})
+	return tripped
+}
+
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
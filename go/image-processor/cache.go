@@ -6,16 +6,19 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/devhou-se/www-jp/go/utils"
 )
 
 const (
-	CacheVersion    = "2.0"
-	CacheFilePath   = "imager-cache.txt"
+	CacheVersion    = "2.1"
+	CacheFilePath   = utils.CacheFilePath
 	CacheBackupPath = "imager-cache.txt.bak"
 )
 
@@ -27,6 +30,37 @@ type CacheEntry struct {
 	Width     int
 	Height    int
 	GCSPaths  []string
+
+	// Optional attributes, stored as key=value fields (v2.1)
+	Color string // Dominant colour as #rrggbb
+	GPS   bool   // Original carried a GPS position in its EXIF
+
+	// EXIF metadata of the original
+	Taken       string // Capture time, RFC 3339 (without zone if unknown)
+	CameraMake  string
+	CameraModel string
+	Location    *Location // Coarsened GPS position, see --gps-precision
+
+	// Validators of the source response, for conditional requests with --revalidate
+	ETag         string
+	LastModified string
+
+	// Archive is the object path of the unmodified original, see --archive-prefix
+	Archive string
+
+	// Encodings is how each variant was encoded, keyed by its name after the
+	// object ID (e.g. "_0.jpeg"). Variants uploaded before this was recorded
+	// have none.
+	Encodings map[string]VariantEncoding
+}
+
+// VariantEncoding is the quality a variant was encoded at, its size and its
+// dimensions. Encodings recorded before the dimensions were have them 0.
+type VariantEncoding struct {
+	Quality int   `json:"quality"`
+	Bytes   int64 `json:"bytes"`
+	Width   int   `json:"width,omitempty"`
+	Height  int   `json:"height,omitempty"`
 }
 
 // ImageCache manages the text-based cache with enhanced metadata
@@ -83,7 +117,7 @@ func (c *ImageCache) Load() error {
 			// If parsing fails, might be old format - try legacy parse
 			entry = c.parseLegacyEntry(line)
 			if entry == nil {
-				fmt.Printf("Warning: skipping invalid cache line %d: %s\n", lineNum, err)
+				slog.Warn("skipping invalid cache line", "line", lineNum, "error", err)
 				continue
 			}
 			c.dirty = true // Mark dirty to trigger save in new format
@@ -96,52 +130,188 @@ func (c *ImageCache) Load() error {
 		return fmt.Errorf("error reading cache: %w", err)
 	}
 
-	fmt.Printf("Loaded %d entries from cache (version %s)\n", len(c.entries), c.version)
+	slog.Info("loaded cache", "entries", len(c.entries), "version", c.version)
 
 	// Auto-upgrade old format
 	if c.dirty {
-		fmt.Println("Cache format upgraded, will save in new format")
+		slog.Info("cache format upgraded, will save in new format", "version", CacheVersion)
 	}
 
 	return nil
 }
 
-// parseCacheEntry parses a v2.0 format cache line
-// Format: filename|hash|timestamp|width|height|gcs_0|gcs_1|gcs_2|gcs_3
+// parseCacheEntry parses a v2.0 or v2.1 format cache line, see utils.ParseCacheLine
 func (c *ImageCache) parseCacheEntry(line string) (*CacheEntry, error) {
-	parts := strings.Split(line, "|")
-	if len(parts) < 5 {
-		return nil, fmt.Errorf("invalid format: expected at least 5 fields, got %d", len(parts))
+	parsed, err := utils.ParseCacheLine(line)
+	if err != nil {
+		return nil, err
 	}
 
-	timestamp, err := strconv.ParseInt(parts[2], 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("invalid timestamp: %w", err)
+	entry := &CacheEntry{
+		Filename:  parsed.Filename,
+		Hash:      parsed.Hash,
+		Timestamp: parsed.Timestamp,
+		Width:     parsed.Width,
+		Height:    parsed.Height,
+		GCSPaths:  parsed.Paths,
+	}
+	for key, value := range parsed.Attributes {
+		entry.setAttribute(key, value)
 	}
 
-	width, err := strconv.Atoi(parts[3])
-	if err != nil {
-		return nil, fmt.Errorf("invalid width: %w", err)
+	return entry, nil
+}
+
+// attributes returns the optional key=value fields for an entry
+func (e *CacheEntry) attributes() []string {
+	var attrs []string
+	if e.Color != "" {
+		attrs = append(attrs, "color="+e.Color)
+	}
+	if e.GPS {
+		attrs = append(attrs, "gps=true")
+	}
+	if e.Taken != "" {
+		attrs = append(attrs, "taken="+e.Taken)
+	}
+	if e.CameraMake != "" {
+		attrs = append(attrs, "make="+e.CameraMake)
+	}
+	if e.CameraModel != "" {
+		attrs = append(attrs, "model="+e.CameraModel)
+	}
+	if e.Location != nil {
+		attrs = append(attrs, "location="+e.Location.String())
 	}
+	if e.ETag != "" {
+		attrs = append(attrs, "etag="+e.ETag)
+	}
+	if e.LastModified != "" {
+		attrs = append(attrs, "last_modified="+e.LastModified)
+	}
+	if e.Archive != "" {
+		attrs = append(attrs, "archive="+e.Archive)
+	}
+	if len(e.Encodings) > 0 {
+		attrs = append(attrs, "encodings="+formatEncodings(e.Encodings))
+	}
+	return attrs
+}
 
-	height, err := strconv.Atoi(parts[4])
-	if err != nil {
-		return nil, fmt.Errorf("invalid height: %w", err)
+// setAttribute applies a key=value field from a cache line.
+// Unknown keys are ignored so newer cache files stay readable.
+func (e *CacheEntry) setAttribute(key, value string) {
+	switch key {
+	case "color":
+		e.Color = value
+	case "gps":
+		e.GPS = value == "true"
+	case "taken":
+		e.Taken = value
+	case "make":
+		e.CameraMake = value
+	case "model":
+		e.CameraModel = value
+	case "location":
+		if location, err := parseLocation(value); err == nil {
+			e.Location = location
+		}
+	case "etag":
+		e.ETag = value
+	case "last_modified":
+		e.LastModified = value
+	case "archive":
+		e.Archive = value
+	case "encodings":
+		e.Encodings = parseEncodings(value)
 	}
+}
 
-	gcsPaths := []string{}
-	if len(parts) > 5 {
-		gcsPaths = parts[5:]
+// encodingKey returns the name of a variant after the object ID, which keys
+// CacheEntry.Encodings
+func encodingKey(objectPath string) (string, bool) {
+	_, rung, format, ok := parseVariantPath(objectPath)
+	if !ok {
+		return "", false
 	}
+	return rung.Suffix + "." + format.Extension, true
+}
 
-	return &CacheEntry{
-		Filename:  parts[0],
-		Hash:      parts[1],
-		Timestamp: timestamp,
-		Width:     width,
-		Height:    height,
-		GCSPaths:  gcsPaths,
-	}, nil
+// Encoding returns how the variant at objectPath was encoded, if recorded
+func (e *CacheEntry) Encoding(objectPath string) (VariantEncoding, bool) {
+	key, ok := encodingKey(objectPath)
+	if !ok {
+		return VariantEncoding{}, false
+	}
+	encoding, ok := e.Encodings[key]
+	return encoding, ok
+}
+
+func (e *CacheEntry) setEncoding(objectPath string, encoding VariantEncoding) {
+	key, ok := encodingKey(objectPath)
+	if !ok {
+		return
+	}
+	if e.Encodings == nil {
+		e.Encodings = make(map[string]VariantEncoding)
+	}
+	e.Encodings[key] = encoding
+}
+
+// formatEncodings writes encodings as name:quality:bytes:widthxheight,
+// comma-separated and sorted by name. Unknown dimensions are left off.
+func formatEncodings(encodings map[string]VariantEncoding) string {
+	keys := make([]string, 0, len(encodings))
+	for key := range encodings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		encoding := encodings[key]
+		field := fmt.Sprintf("%s:%d:%d", key, encoding.Quality, encoding.Bytes)
+		if encoding.Width > 0 && encoding.Height > 0 {
+			field += fmt.Sprintf(":%dx%d", encoding.Width, encoding.Height)
+		}
+		fields = append(fields, field)
+	}
+	return strings.Join(fields, ",")
+}
+
+// parseEncodings reads the value of an encodings attribute, with or without
+// dimensions, skipping malformed fields
+func parseEncodings(value string) map[string]VariantEncoding {
+	encodings := make(map[string]VariantEncoding)
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 && len(parts) != 4 {
+			continue
+		}
+		quality, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		encoding := VariantEncoding{Quality: quality, Bytes: size}
+		if len(parts) == 4 {
+			width, height, ok := strings.Cut(parts[3], "x")
+			if !ok {
+				continue
+			}
+			if encoding.Width, err = strconv.Atoi(width); err != nil {
+				continue
+			}
+			if encoding.Height, err = strconv.Atoi(height); err != nil {
+				continue
+			}
+		}
+		encodings[parts[0]] = encoding
+	}
+	return encodings
 }
 
 // parseLegacyEntry parses a v1.0 format cache line (just filename)
@@ -162,7 +332,7 @@ func (c *ImageCache) parseLegacyEntry(line string) *CacheEntry {
 	}
 }
 
-// Save writes the cache to disk in the v2.0 format
+// Save writes the cache to disk in the v2.1 format
 func (c *ImageCache) Save() error {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -170,7 +340,7 @@ func (c *ImageCache) Save() error {
 	// Create backup of existing cache
 	if _, err := os.Stat(CacheFilePath); err == nil {
 		if err := os.Rename(CacheFilePath, CacheBackupPath); err != nil {
-			fmt.Printf("Warning: failed to create cache backup: %v\n", err)
+			slog.Warn("failed to create cache backup", "error", err)
 		}
 	}
 
@@ -184,7 +354,7 @@ func (c *ImageCache) Save() error {
 
 	// Write header
 	fmt.Fprintf(writer, "# Version: %s\n", CacheVersion)
-	fmt.Fprintf(writer, "# Format: filename|hash|timestamp|width|height|gcs_0|gcs_1|gcs_2|gcs_3\n")
+	fmt.Fprintf(writer, "# Format: %s\n", utils.CacheFormat)
 	fmt.Fprintln(writer)
 
 	// Sort entries for consistent output
@@ -205,6 +375,10 @@ func (c *ImageCache) Save() error {
 			entry.Height,
 		)
 
+		if attrs := entry.attributes(); len(attrs) > 0 {
+			line += "|" + strings.Join(attrs, "|")
+		}
+
 		if len(entry.GCSPaths) > 0 {
 			line += "|" + strings.Join(entry.GCSPaths, "|")
 		}
@@ -228,6 +402,18 @@ func (c *ImageCache) Get(filename string) (*CacheEntry, bool) {
 	return entry, ok
 }
 
+// FindByHash returns an entry whose original has the given content hash (thread-safe)
+func (c *ImageCache) FindByHash(hash string) (*CacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, entry := range c.entries {
+		if entry.Hash == hash {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
 // Has checks if a filename exists in cache (thread-safe)
 func (c *ImageCache) Has(filename string) bool {
 	c.mu.RLock()
@@ -252,6 +438,20 @@ func (c *ImageCache) Remove(filename string) {
 	c.dirty = true
 }
 
+// Entries returns all cache entries sorted by filename (thread-safe)
+func (c *ImageCache) Entries() []*CacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries := make([]*CacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Filename < entries[j].Filename
+	})
+	return entries
+}
+
 // Size returns the number of cached entries
 func (c *ImageCache) Size() int {
 	c.mu.RLock()
@@ -297,16 +497,21 @@ func (c *ImageCache) Stats() map[string]interface{} {
 	// Count entries with/without hash
 	withHash := 0
 	withoutHash := 0
+	withGPS := 0
 	for _, entry := range c.entries {
 		if entry.Hash != "" {
 			withHash++
 		} else {
 			withoutHash++
 		}
+		if entry.GPS {
+			withGPS++
+		}
 	}
 
 	stats["entries_with_hash"] = withHash
 	stats["entries_without_hash"] = withoutHash
+	stats["entries_with_gps"] = withGPS
 
 	return stats
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// maxImageBytes is the largest original that will be fetched
+	maxImageBytes int64 = 200 << 20
+	// spillThreshold is the size above which originals are kept in a temp file
+	// instead of in memory
+	spillThreshold int64 = 32 << 20
+
+	errImageTooLarge = permanent(errors.New("image too large"))
+	// errNotModified is returned by conditional downloads of unchanged sources
+	errNotModified = errors.New("not modified")
+)
+
+// sourceValidators are the ETag and Last-Modified a source was last fetched
+// with, sent as If-None-Match and If-Modified-Since
+type sourceValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// imageBlob holds the bytes of an original image, in memory or, above
+// spillThreshold, in a temporary file. Close must be called to remove the file.
+type imageBlob struct {
+	data []byte
+	file *os.File
+	size int64
+
+	// Validators from the response headers, empty for local files
+	ETag         string
+	LastModified string
+}
+
+// Size returns the number of bytes in the blob
+func (b *imageBlob) Size() int64 {
+	return b.size
+}
+
+// Reader returns a new reader positioned at the start of the blob
+func (b *imageBlob) Reader() io.ReadSeeker {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.data)
+}
+
+// InMemory returns the number of bytes of the blob held in memory
+func (b *imageBlob) InMemory() int64 {
+	return int64(len(b.data))
+}
+
+// Close removes the temp file of a spilled blob
+func (b *imageBlob) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// readBlob streams r into a blob, failing once more than maxImageBytes have
+// been read. sizeHint is the expected size (e.g. Content-Length), or -1 if
+// unknown; a known size over the limit fails without reading anything.
+func readBlob(r io.Reader, sizeHint int64) (*imageBlob, error) {
+	if sizeHint > maxImageBytes {
+		return nil, fmt.Errorf("%w: %d bytes (limit %d)", errImageTooLarge, sizeHint, maxImageBytes)
+	}
+
+	limited := io.LimitReader(r, maxImageBytes+1)
+
+	// Small originals are read into memory; the first spillThreshold bytes are
+	// buffered unless the size is already known to be larger
+	var head []byte
+	if sizeHint <= spillThreshold {
+		var err error
+		head, err = io.ReadAll(io.LimitReader(limited, spillThreshold+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(head)) <= spillThreshold {
+			if int64(len(head)) > maxImageBytes {
+				return nil, fmt.Errorf("%w: over %d bytes", errImageTooLarge, maxImageBytes)
+			}
+			return &imageBlob{data: head, size: int64(len(head))}, nil
+		}
+	}
+
+	file, err := os.CreateTemp("", "image-processor-original-*")
+	if err != nil {
+		return nil, err
+	}
+	blob := &imageBlob{file: file}
+
+	if _, err := file.Write(head); err != nil {
+		blob.Close()
+		return nil, err
+	}
+	n, err := io.Copy(file, limited)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+
+	blob.size = int64(len(head)) + n
+	if blob.size > maxImageBytes {
+		blob.Close()
+		return nil, fmt.Errorf("%w: over %d bytes", errImageTooLarge, maxImageBytes)
+	}
+	return blob, nil
+}
+
+// fetchImage returns the original of an image from a URL or local path.
+// With validators, a web source that has not changed returns errNotModified.
+func fetchImage(ctx context.Context, source string, validators *sourceValidators) (*imageBlob, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return downloadImageWithRetry(ctx, source, validators, maxRetries)
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, permanent(err)
+	}
+	return readBlob(file, info.Size())
+}
+
+// downloadImageWithRetry downloads an image, retrying transient failures with
+// jittered exponential backoff or as long as the server asks via Retry-After.
+// Permanent failures, cancellation of ctx and a tripped circuit breaker for the
+// host return immediately.
+func downloadImageWithRetry(ctx context.Context, url string, validators *sourceValidators, maxRetries int) (*imageBlob, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if err := hostBreaker.Allow(url); err != nil {
+			return nil, err
+		}
+
+		blob, wait, err := downloadImage(ctx, url, validators)
+		if errors.Is(err, errNotModified) {
+			hostBreaker.Record(url, nil)
+			return nil, err
+		}
+		hostBreaker.Record(url, err)
+		if err == nil {
+			return blob, nil
+		}
+		lastErr = err
+
+		if classifyError(err) != ErrorRetryable || attempt == maxRetries {
+			break
+		}
+
+		if err := sleepContext(ctx, max(backoffDelay(attempt), wait)); err != nil {
+			return nil, err
+		}
+	}
+
+	if classifyError(lastErr) != ErrorRetryable {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
+}
+
+// downloadImage makes a single download attempt. On failure it returns how
+// long the server asked to wait before retrying, if it did.
+func downloadImage(ctx context.Context, url string, validators *sourceValidators) (*imageBlob, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, permanent(err)
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, 0, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, retryAfter(resp, time.Now()), httpStatusError(resp)
+	}
+
+	// ContentLength is -1 when the server doesn't send it
+	blob, err := readBlob(resp.Body, resp.ContentLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	blob.ETag = cacheSafe(resp.Header.Get("ETag"))
+	blob.LastModified = cacheSafe(resp.Header.Get("Last-Modified"))
+	return blob, 0, nil
+}
+
+// cacheSafe returns a header value, or "" if it can't be stored in a cache field
+func cacheSafe(value string) string {
+	if strings.ContainsAny(value, "|\r\n") {
+		return ""
+	}
+	return value
+}
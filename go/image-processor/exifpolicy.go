@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+)
+
+// EXIF policies, selected with --exif-policy
+const (
+	// exifPolicyKeep copies the original EXIF block onto variants unchanged
+	exifPolicyKeep = "keep"
+	// exifPolicyStripGPS removes the GPS IFD and keeps everything else
+	exifPolicyStripGPS = "strip-gps"
+	// exifPolicyAllowlist keeps only the tags listed below, dropping GPS,
+	// serial numbers, owner names, maker notes and the thumbnail
+	exifPolicyAllowlist = "allowlist"
+)
+
+// exifPolicy is the policy applied to the EXIF block written onto variants
+var exifPolicy = exifPolicyAllowlist
+
+// gpsInfoTagID points from IFD0 to the GPS IFD
+const gpsInfoTagID = 0x8825
+
+// Tags kept by the allowlist policy
+var (
+	allowedRootTags = []uint16{
+		0x010f, // Make
+		0x0110, // Model
+		0x0112, // Orientation
+		0x011a, // XResolution
+		0x011b, // YResolution
+		0x0128, // ResolutionUnit
+		0x0132, // DateTime
+		0x8298, // Copyright
+	}
+	allowedExifTags = []uint16{
+		0x829a, // ExposureTime
+		0x829d, // FNumber
+		0x8822, // ExposureProgram
+		0x8827, // ISOSpeedRatings
+		0x9003, // DateTimeOriginal
+		0x9004, // DateTimeDigitized
+		0x9010, // OffsetTime
+		0x9011, // OffsetTimeOriginal
+		0x9201, // ShutterSpeedValue
+		0x9202, // ApertureValue
+		0x9204, // ExposureBiasValue
+		0x9207, // MeteringMode
+		0x9209, // Flash
+		0x920a, // FocalLength
+		0xa001, // ColorSpace
+		0xa402, // ExposureMode
+		0xa403, // WhiteBalance
+		0xa405, // FocalLengthIn35mmFilm
+		0xa406, // SceneCaptureType
+		0xa433, // LensMake
+		0xa434, // LensModel
+	}
+)
+
+func parseExifPolicy(policy string) (string, error) {
+	switch policy {
+	case exifPolicyKeep, exifPolicyStripGPS, exifPolicyAllowlist:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown EXIF policy %q (expected %s, %s or %s)", policy, exifPolicyKeep, exifPolicyStripGPS, exifPolicyAllowlist)
+	}
+}
+
+// buildExifBuilder returns the EXIF block to write onto variants of an image
+// with the given parsed EXIF, filtered according to policy
+func buildExifBuilder(rootIfd *exif.Ifd, policy string) (*exif.IfdBuilder, error) {
+	switch policy {
+	case exifPolicyKeep:
+		return exif.NewIfdBuilderFromExistingChain(rootIfd), nil
+
+	case exifPolicyStripGPS:
+		ib := exif.NewIfdBuilderFromExistingChain(rootIfd)
+		if _, err := ib.DeleteAll(gpsInfoTagID); err != nil {
+			return nil, err
+		}
+		return ib, nil
+
+	case exifPolicyAllowlist:
+		// Only IFD0 is copied, so the IFD1 thumbnail is dropped as well
+		ib := exif.NewIfdBuilderWithExistingIfd(rootIfd)
+		if err := ib.AddTagsFromExisting(rootIfd, allowedRootTags, nil); err != nil {
+			return nil, err
+		}
+
+		exifIfd, err := rootIfd.ChildWithIfdPath(exifcommon.IfdExifStandardIfdIdentity)
+		if err != nil {
+			// No Exif sub-IFD
+			return ib, nil
+		}
+		child := exif.NewIfdBuilderWithExistingIfd(exifIfd)
+		if err := child.AddTagsFromExisting(exifIfd, allowedExifTags, nil); err != nil {
+			return nil, err
+		}
+		if err := ib.AddChildIb(child); err != nil {
+			return nil, err
+		}
+		return ib, nil
+
+	default:
+		return nil, fmt.Errorf("unknown EXIF policy %q", policy)
+	}
+}
+
+// exifGPS returns the GPS position recorded in an image's EXIF, or nil if it
+// has none
+func exifGPS(rootIfd *exif.Ifd) *exif.GpsInfo {
+	gpsIfd, err := rootIfd.ChildWithIfdPath(exifcommon.IfdGpsInfoStandardIfdIdentity)
+	if err != nil {
+		return nil
+	}
+	gi, err := gpsIfd.GpsInfo()
+	if err != nil {
+		return nil
+	}
+	return gi
+}
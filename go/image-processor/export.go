@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devhou-se/www-jp/go/utils"
+)
+
+// ExportRecord is a cache entry plus derived fields, as written by --maintenance export
+type ExportRecord struct {
+	Filename    string                     `json:"filename"`
+	ID          string                     `json:"id"`
+	Hash        string                     `json:"hash"`
+	Timestamp   int64                      `json:"timestamp"`
+	ProcessedAt string                     `json:"processed_at,omitempty"`
+	Width       int                        `json:"width"`
+	Height      int                        `json:"height"`
+	AspectRatio float64                    `json:"aspect_ratio"`
+	Legacy      bool                       `json:"legacy"`
+	GCSPaths    []string                   `json:"gcs_paths"`
+	Rungs       []string                   `json:"rungs"`
+	Archive     string                     `json:"archive,omitempty"`
+	Encodings   map[string]VariantEncoding `json:"encodings"`
+	Posts       []string                   `json:"posts"`
+	Taken       string                     `json:"taken,omitempty"`
+	CameraMake  string                     `json:"camera_make,omitempty"`
+	CameraModel string                     `json:"camera_model,omitempty"`
+	Latitude    *float64                   `json:"latitude,omitempty"`
+	Longitude   *float64                   `json:"longitude,omitempty"`
+}
+
+// exportCache writes every cache entry to config.ExportOut in config.ExportFormat
+func exportCache(cache *ImageCache, config *Config) error {
+	var write func(io.Writer, []ExportRecord) error
+	switch config.ExportFormat {
+	case "json":
+		write = writeExportJSON
+	case "jsonl":
+		write = writeExportJSONLines
+	case "csv":
+		write = writeExportCSV
+	default:
+		return fmt.Errorf("unknown export format %q (expected json, csv or jsonl)", config.ExportFormat)
+	}
+	if config.ExportOut == "" {
+		return fmt.Errorf("--out is required for export")
+	}
+
+	postsByKey, postsByID, err := imagePosts()
+	if err != nil {
+		return fmt.Errorf("failed to find image references: %w", err)
+	}
+
+	entries := cache.Entries()
+	records := make([]ExportRecord, 0, len(entries))
+	for _, entry := range entries {
+		posts := mergeSorted(postsByKey[entry.Filename], postsByID[entry.ObjectID()])
+		records = append(records, newExportRecord(entry, posts))
+	}
+
+	out, err := os.Create(config.ExportOut)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer out.Close()
+
+	if err := write(out, records); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+
+	slog.Info("exported cache", "path", config.ExportOut, "format", config.ExportFormat, "entries", len(records))
+	return nil
+}
+
+func newExportRecord(entry *CacheEntry, posts []string) ExportRecord {
+	record := ExportRecord{
+		Filename:    entry.Filename,
+		ID:          entry.ObjectID(),
+		Hash:        entry.Hash,
+		Timestamp:   entry.Timestamp,
+		Width:       entry.Width,
+		Height:      entry.Height,
+		Legacy:      isLegacyEntry(entry),
+		GCSPaths:    entry.GCSPaths,
+		Rungs:       entry.Rungs(),
+		Archive:     entry.Archive,
+		Encodings:   entry.Encodings,
+		Posts:       posts,
+		Taken:       entry.Taken,
+		CameraMake:  entry.CameraMake,
+		CameraModel: entry.CameraModel,
+	}
+
+	if entry.Location != nil {
+		record.Latitude = &entry.Location.Lat
+		record.Longitude = &entry.Location.Lon
+	}
+
+	if entry.Timestamp > 0 {
+		record.ProcessedAt = time.Unix(entry.Timestamp, 0).UTC().Format(time.RFC3339)
+	}
+	if entry.Height > 0 {
+		record.AspectRatio = float64(entry.Width) / float64(entry.Height)
+	}
+
+	// Always emit arrays rather than null
+	if record.GCSPaths == nil {
+		record.GCSPaths = []string{}
+	}
+	if record.Rungs == nil {
+		record.Rungs = []string{}
+	}
+	if record.Posts == nil {
+		record.Posts = []string{}
+	}
+	if record.Encodings == nil {
+		record.Encodings = map[string]VariantEncoding{}
+	}
+
+	return record
+}
+
+// imagePosts finds the markdown files that reference each image. Links are
+// mapped by cache key (under either layout), lazyimage shortcodes by object ID.
+func imagePosts() (byKey, byID map[string][]string, err error) {
+	images, err := utils.Images()
+	if err != nil {
+		return nil, nil, err
+	}
+	lazyImages, err := utils.LazyImages()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byKey = make(map[string][]string)
+	for _, img := range images {
+		source := imageSource(img)
+		byKey[source] = append(byKey[source], img.InFile)
+		if filename := utils.ImageFilename(source); filename != source {
+			byKey[filename] = append(byKey[filename], img.InFile)
+		}
+	}
+
+	byID = make(map[string][]string)
+	for _, img := range lazyImages {
+		byID[img.ID] = append(byID[img.ID], img.InFile)
+	}
+
+	return byKey, byID, nil
+}
+
+// mergeSorted returns the sorted, de-duplicated union of two lists
+func mergeSorted(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	for _, s := range a {
+		seen[s] = true
+	}
+	for _, s := range b {
+		seen[s] = true
+	}
+	return sortedKeys(seen)
+}
+
+func writeExportJSON(w io.Writer, records []ExportRecord) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
+
+func writeExportJSONLines(w io.Writer, records []ExportRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExportCSV(w io.Writer, records []ExportRecord) error {
+	writer := csv.NewWriter(w)
+
+	header := []string{"filename", "id", "hash", "timestamp", "processed_at", "width", "height", "aspect_ratio", "legacy", "gcs_paths", "rungs", "archive", "encodings", "posts", "taken", "camera_make", "camera_model", "latitude", "longitude"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		row := []string{
+			record.Filename,
+			record.ID,
+			record.Hash,
+			strconv.FormatInt(record.Timestamp, 10),
+			record.ProcessedAt,
+			strconv.Itoa(record.Width),
+			strconv.Itoa(record.Height),
+			strconv.FormatFloat(record.AspectRatio, 'f', 4, 64),
+			strconv.FormatBool(record.Legacy),
+			// Multi-valued fields are joined so each entry stays on one row
+			strings.Join(record.GCSPaths, ";"),
+			strings.Join(record.Rungs, ";"),
+			record.Archive,
+			formatEncodings(record.Encodings),
+			strings.Join(record.Posts, ";"),
+			record.Taken,
+			record.CameraMake,
+			record.CameraModel,
+			formatOptionalFloat(record.Latitude),
+			formatOptionalFloat(record.Longitude),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatOptionalFloat(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
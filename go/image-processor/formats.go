@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ImageFormat describes an encoding that variants can be written in
+type ImageFormat struct {
+	Name        string
+	Extension   string
+	ContentType string
+
+	// Tool is the external encoder binary, empty for formats encoded natively
+	Tool string
+
+	// DefaultQuality is used for rungs that don't set a quality
+	DefaultQuality int
+
+	encode func(ctx context.Context, img image.Image, quality int) ([]byte, error)
+}
+
+var (
+	jpegFormat = &ImageFormat{
+		Name:           "jpeg",
+		Extension:      "jpeg",
+		ContentType:    "image/jpeg",
+		DefaultQuality: jpeg.DefaultQuality,
+		encode:         encodeJPEG,
+	}
+	webpFormat = &ImageFormat{
+		Name:           "webp",
+		Extension:      "webp",
+		ContentType:    "image/webp",
+		Tool:           "cwebp",
+		DefaultQuality: 75,
+		encode:         encodeWebP,
+	}
+	avifFormat = &ImageFormat{
+		Name:           "avif",
+		Extension:      "avif",
+		ContentType:    "image/avif",
+		Tool:           "avifenc",
+		DefaultQuality: 60,
+		encode:         encodeAVIF,
+	}
+
+	// allFormats lists every known format, JPEG first
+	allFormats = []*ImageFormat{jpegFormat, webpFormat, avifFormat}
+)
+
+// Encode encodes img in this format at a quality from 1 to 100, or the
+// format's default quality if quality is 0. Cancelling ctx stops an external
+// encoder.
+func (f *ImageFormat) Encode(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	return f.encode(ctx, img, f.Quality(quality))
+}
+
+// Quality returns the quality an encode at quality uses: the format's
+// default for 0
+func (f *ImageFormat) Quality(quality int) int {
+	if quality == 0 {
+		return f.DefaultQuality
+	}
+	return quality
+}
+
+// encodeWithinBudget returns the output of encode at the highest quality from
+// minQuality to maxQuality whose output is at most maxBytes, and that quality.
+// Quality is binary-searched, assuming size grows with it. If even minQuality
+// is over budget its output is returned anyway; the caller can tell from the
+// size. A maxBytes of 0 means no budget and encodes at maxQuality only.
+func encodeWithinBudget(maxQuality, minQuality int, maxBytes int64, encode func(quality int) ([]byte, error)) ([]byte, int, error) {
+	data, err := encode(maxQuality)
+	if err != nil || maxBytes <= 0 || int64(len(data)) <= maxBytes {
+		return data, maxQuality, err
+	}
+
+	// With every quality over budget the search ends having tried minQuality,
+	// so that is the last output kept
+	best, bestQuality := data, maxQuality
+	found := false
+	low, high := min(minQuality, maxQuality), maxQuality-1
+	for low <= high {
+		quality := (low + high) / 2
+		data, err := encode(quality)
+		if err != nil {
+			return nil, 0, err
+		}
+		if int64(len(data)) <= maxBytes {
+			best, bestQuality, found = data, quality, true
+			low = quality + 1
+		} else {
+			if !found {
+				best, bestQuality = data, quality
+			}
+			high = quality - 1
+		}
+	}
+	return best, bestQuality, nil
+}
+
+// Available reports whether the format's encoder can be used on this machine
+func (f *ImageFormat) Available() bool {
+	if f.Tool == "" {
+		return true
+	}
+	_, err := exec.LookPath(f.Tool)
+	return err == nil
+}
+
+// parseFormats resolves a comma-separated list of format names.
+// JPEG is always included as the fallback format, and formats whose
+// encoder is not installed are dropped with a warning.
+func parseFormats(list string) ([]*ImageFormat, error) {
+	formats := []*ImageFormat{jpegFormat}
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == jpegFormat.Name {
+			continue
+		}
+
+		format := formatByName(name)
+		if format == nil {
+			return nil, fmt.Errorf("unknown image format %q", name)
+		}
+		if !format.Available() {
+			slog.Warn("encoder not found in PATH, skipping format", "tool", format.Tool, "format", format.Name)
+			continue
+		}
+		formats = append(formats, format)
+	}
+
+	return formats, nil
+}
+
+func formatByName(name string) *ImageFormat {
+	for _, format := range allFormats {
+		if format.Name == name {
+			return format
+		}
+	}
+	return nil
+}
+
+// formatByExtension returns the format for a file extension (with or without the dot)
+func formatByExtension(ext string) *ImageFormat {
+	ext = strings.TrimPrefix(strings.ToLower(ext), ".")
+	if ext == "jpg" {
+		ext = "jpeg"
+	}
+	for _, format := range allFormats {
+		if format.Extension == ext {
+			return format
+		}
+	}
+	return nil
+}
+
+func encodeJPEG(_ context.Context, img image.Image, quality int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeWebP(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	return encodeWithTool(ctx, img, ".webp", func(in, out string) []string {
+		return []string{"cwebp", "-quiet", "-q", strconv.Itoa(quality), "-metadata", "none", in, "-o", out}
+	})
+}
+
+func encodeAVIF(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	return encodeWithTool(ctx, img, ".avif", func(in, out string) []string {
+		return []string{"avifenc", "--speed", "6", "-q", strconv.Itoa(quality), in, out}
+	})
+}
+
+// encodeWithTool writes img to a temporary PNG, runs an external encoder
+// over it and returns the encoded output. The encoder is killed if ctx is
+// cancelled.
+func encodeWithTool(ctx context.Context, img image.Image, ext string, args func(in, out string) []string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "image-processor-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.png")
+	out := filepath.Join(dir, "out"+ext)
+
+	file, err := os.Create(in)
+	if err != nil {
+		return nil, err
+	}
+	// Fastest compression: the PNG is only an intermediate
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(file, img); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	argv := args(in, out)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%s failed: %w: %s", argv[0], err, strings.TrimSpace(string(output)))
+	}
+
+	return os.ReadFile(out)
+}
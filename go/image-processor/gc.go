@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/devhou-se/www-jp/go/utils"
+)
+
+// GCPlan lists what a garbage collection run will delete
+type GCPlan struct {
+	Objects []string
+	Entries []string
+	// Archives are archived originals, in the archive store
+	Archives []string
+}
+
+// buildGCPlan finds cache entries and objects whose image is no longer referenced
+// by any post, as a web or local link or a lazyimage shortcode. Images touched
+// within the grace period are kept; for entries this is the cache timestamp, for
+// objects without an entry the newest creation time. Archived originals are
+// deleted with the last entry that points at them.
+func buildGCPlan(ctx context.Context, store ObjectStore, cache *ImageCache, grace time.Duration) (*GCPlan, error) {
+	images, err := utils.Images()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find image references: %w", err)
+	}
+	lazyImages, err := utils.LazyImages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find image references: %w", err)
+	}
+
+	// Cache keys of linked images (under either layout) and object IDs still in use
+	referencedKeys := make(map[string]bool)
+	liveIDs := make(map[string]bool)
+	for _, img := range images {
+		source := imageSource(img)
+		filename := utils.ImageFilename(source)
+		referencedKeys[source] = true
+		referencedKeys[filename] = true
+		liveIDs[utils.ImageID(filename)] = true
+	}
+	for _, img := range lazyImages {
+		liveIDs[img.ID] = true
+	}
+
+	objects, err := store.List(ctx, gcsImagePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	cutoff := time.Now().Add(-grace)
+	plan := &GCPlan{}
+
+	// Entries sharing an object ID with a live entry only lose their cache line
+	orphanIDs := make(map[string]bool)
+	archives := make(map[string]string)
+	for _, entry := range cache.Entries() {
+		id := entry.ObjectID()
+		if referencedKeys[entry.Filename] || liveIDs[id] {
+			liveIDs[id] = true
+			continue
+		}
+		// Legacy entries have no timestamp and are always old enough
+		if entry.Timestamp > 0 && time.Unix(entry.Timestamp, 0).After(cutoff) {
+			liveIDs[id] = true
+			continue
+		}
+
+		plan.Entries = append(plan.Entries, entry.Filename)
+		orphanIDs[id] = true
+		if entry.Archive != "" {
+			archives[id] = entry.Archive
+		}
+	}
+
+	for id, archive := range archives {
+		if !liveIDs[id] {
+			plan.Archives = append(plan.Archives, archive)
+		}
+	}
+
+	// Group objects by image ID
+	objectsByID := make(map[string][]ObjectAttrs)
+	for _, attrs := range objects {
+		base, _, _, ok := parseVariantPath(attrs.Name)
+		if !ok {
+			continue
+		}
+		objectsByID[base] = append(objectsByID[base], attrs)
+	}
+
+	for id, attrs := range objectsByID {
+		if liveIDs[id] {
+			continue
+		}
+
+		if !orphanIDs[id] {
+			recent := false
+			for _, a := range attrs {
+				if a.Created.After(cutoff) {
+					recent = true
+				}
+			}
+			if recent {
+				continue
+			}
+		}
+
+		for _, a := range attrs {
+			plan.Objects = append(plan.Objects, a.Name)
+		}
+	}
+
+	sort.Strings(plan.Entries)
+	sort.Strings(plan.Objects)
+	sort.Strings(plan.Archives)
+	return plan, nil
+}
+
+// collectGarbage deletes unreferenced objects and cache entries.
+//
+// A dry run is mandatory: with --dry-run the plan is printed and written to
+// config.GCPlan. A real run only deletes what that plan lists and what is still
+// unreferenced, then removes the plan file.
+func collectGarbage(ctx context.Context, store ObjectStore, cache *ImageCache, config *Config) error {
+	slog.Info("collecting unreferenced images")
+
+	plan, err := buildGCPlan(ctx, store, cache, config.GCGrace)
+	if err != nil {
+		return err
+	}
+
+	if config.DryRun {
+		plan.Print()
+		if err := plan.Save(config.GCPlan); err != nil {
+			return fmt.Errorf("failed to save gc plan: %w", err)
+		}
+		slog.Info("gc plan written, run again without --dry-run to delete", "path", config.GCPlan)
+		return nil
+	}
+
+	approved, err := loadGCPlan(config.GCPlan)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no gc plan at %s, run with --dry-run first", config.GCPlan)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load gc plan: %w", err)
+	}
+
+	plan = plan.Intersect(approved)
+	plan.Print()
+
+	deleted := 0
+	for _, objectPath := range plan.Objects {
+		if err := store.Delete(ctx, objectPath); err != nil && !errors.Is(err, ErrObjectNotExist) {
+			return fmt.Errorf("failed to delete %s: %w", objectPath, err)
+		}
+		deleted++
+	}
+	for _, objectPath := range plan.Archives {
+		if archiveStore == nil {
+			slog.Warn("archived original left in place, no --archive-bucket", "variant", objectPath)
+			continue
+		}
+		if err := archiveStore.Delete(ctx, objectPath); err != nil && !errors.Is(err, ErrObjectNotExist) {
+			return fmt.Errorf("failed to delete %s: %w", objectPath, err)
+		}
+		deleted++
+	}
+
+	for _, filename := range plan.Entries {
+		cache.Remove(filename)
+	}
+
+	if err := cache.Save(); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	if err := updateHugoData(cache, config); err != nil {
+		return fmt.Errorf("failed to write hugo data: %w", err)
+	}
+	if err := os.Remove(config.GCPlan); err != nil {
+		slog.Warn("failed to remove gc plan", "error", err)
+	}
+
+	slog.Info("garbage collected", "objects", deleted, "entries", len(plan.Entries))
+	return nil
+}
+
+// Intersect returns the items present in both plans
+func (p *GCPlan) Intersect(other *GCPlan) *GCPlan {
+	return &GCPlan{
+		Objects:  intersect(p.Objects, other.Objects),
+		Entries:  intersect(p.Entries, other.Entries),
+		Archives: intersect(p.Archives, other.Archives),
+	}
+}
+
+// Print logs the plan, one record per entry and object
+func (p *GCPlan) Print() {
+	slog.Info("garbage collection plan", "entries", len(p.Entries), "objects", len(p.Objects), "archives", len(p.Archives))
+
+	for _, filename := range p.Entries {
+		slog.Info("gc entry", "filename", filename)
+	}
+	for _, objectPath := range p.Objects {
+		slog.Info("gc object", "variant", objectPath)
+	}
+	for _, objectPath := range p.Archives {
+		slog.Info("gc archive", "variant", objectPath)
+	}
+}
+
+// Save writes the plan to disk, one "entry <filename>", "object <path>" or
+// "archive <path>" per line
+func (p *GCPlan) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "# Generated: %s\n", time.Now().UTC().Format(time.RFC3339))
+	for _, filename := range p.Entries {
+		fmt.Fprintf(writer, "entry %s\n", filename)
+	}
+	for _, objectPath := range p.Objects {
+		fmt.Fprintf(writer, "object %s\n", objectPath)
+	}
+	for _, objectPath := range p.Archives {
+		fmt.Fprintf(writer, "archive %s\n", objectPath)
+	}
+	return writer.Flush()
+}
+
+func loadGCPlan(path string) (*GCPlan, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	plan := &GCPlan{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, name, _ := strings.Cut(line, " ")
+		switch kind {
+		case "entry":
+			plan.Entries = append(plan.Entries, name)
+		case "object":
+			plan.Objects = append(plan.Objects, name)
+		case "archive":
+			plan.Archives = append(plan.Archives, name)
+		default:
+			return nil, fmt.Errorf("invalid plan line: %s", line)
+		}
+	}
+	return plan, scanner.Err()
+}
+
+func intersect(a, b []string) []string {
+	set := make(map[string]bool, len(b))
+	for _, s := range b {
+		set[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if set[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
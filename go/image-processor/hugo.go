@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/nfnt/resize"
+
+	"github.com/devhou-se/www-jp/go/utils"
+)
+
+const (
+	publicBaseURL = "https://storage.googleapis.com/" + gcsBucketName
+)
+
+// HugoImage is the per-image record in the Hugo data file, keyed by the
+// object ID that the lazyimage shortcode takes
+type HugoImage struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Color  string `json:"color,omitempty"`
+
+	// EXIF metadata of the original
+	Taken    string    `json:"taken,omitempty"`
+	Camera   string    `json:"camera,omitempty"`
+	Location *Location `json:"location,omitempty"`
+
+	// Variants maps a format name to its variants, smallest first
+	Variants map[string][]HugoVariant `json:"variants"`
+}
+
+// HugoVariant is a single resized copy of an image. Only rungs that exist
+// are listed: those wider than the original are never written.
+type HugoVariant struct {
+	Rung  string `json:"rung"`
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+}
+
+// writeHugoData writes the image dimensions data file read by the site templates.
+// Entries without dimensions (legacy entries not yet repaired) are left out.
+//
+// Templates that only see a post's image URL look it up by the URL's last
+// segment. Under the content layout objects are named by hash instead, so each
+// such image is also listed under its URL ID, unless that ID is an image of
+// its own or is shared by several sources. Local images are named by hash under
+// either layout, and listed under their path in the site directory instead
+// (see localDataKey).
+func writeHugoData(cache *ImageCache, dataPath string) error {
+	images := make(map[string]HugoImage)
+	aliases := make(map[string][]string)
+
+	for _, entry := range cache.Entries() {
+		if entry.Width == 0 || entry.Height == 0 {
+			continue
+		}
+		id := entry.ObjectID()
+		images[id] = newHugoImage(entry)
+
+		if isLocalImage(entry.Filename) {
+			images[localDataKey(entry.Filename)] = images[id]
+			continue
+		}
+		urlID := utils.ImageID(utils.ImageFilename(entry.Filename))
+		if urlID != id && !slices.Contains(aliases[urlID], id) {
+			aliases[urlID] = append(aliases[urlID], id)
+		}
+	}
+
+	for urlID, ids := range aliases {
+		if _, ok := images[urlID]; ok || len(ids) > 1 {
+			continue
+		}
+		images[urlID] = images[ids[0]]
+	}
+
+	if err := writeJSONFile(dataPath, images); err != nil {
+		return err
+	}
+
+	slog.Info("wrote hugo data", "path", dataPath, "images", len(images))
+	return nil
+}
+
+// localDataKey returns the key a local image is listed under in the Hugo data,
+// its path in the site directory with forward slashes (content/posts/a/cover.jpg
+// or static/img/map.png), which the Markdown image render hook rebuilds from the
+// page and link
+func localDataKey(source string) string {
+	if rel, err := filepath.Rel(utils.SiteDirectory, source); err == nil {
+		source = rel
+	}
+	return filepath.ToSlash(source)
+}
+
+// HugoPhotoLocation is a geotagged image in the Hugo locations data file
+type HugoPhotoLocation struct {
+	ID    string  `json:"id"`
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Taken string  `json:"taken,omitempty"`
+}
+
+// writeHugoLocations writes the geotagged images of each post, keyed by the
+// post's path relative to the content directory (Hugo's .File.Path)
+func writeHugoLocations(cache *ImageCache, dataPath string) error {
+	postsByKey, postsByID, err := imagePosts()
+	if err != nil {
+		return fmt.Errorf("failed to find image references: %w", err)
+	}
+
+	contentDir := filepath.Join(utils.SiteDirectory, contentDirectory)
+	locations := make(map[string][]HugoPhotoLocation)
+	count := 0
+
+	for _, entry := range cache.Entries() {
+		if entry.Location == nil {
+			continue
+		}
+
+		id := entry.ObjectID()
+		for _, post := range mergeSorted(postsByKey[entry.Filename], postsByID[id]) {
+			rel, err := filepath.Rel(contentDir, post)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			key := filepath.ToSlash(rel)
+			locations[key] = append(locations[key], HugoPhotoLocation{
+				ID:    id,
+				Lat:   entry.Location.Lat,
+				Lon:   entry.Location.Lon,
+				Taken: entry.Taken,
+			})
+		}
+		count++
+	}
+
+	// Each post's photos in the order they were taken
+	for _, photos := range locations {
+		sort.SliceStable(photos, func(i, j int) bool {
+			return photos[i].Taken < photos[j].Taken
+		})
+	}
+
+	if err := writeJSONFile(dataPath, locations); err != nil {
+		return err
+	}
+
+	slog.Info("wrote photo locations", "path", dataPath, "images", count, "posts", len(locations))
+	return nil
+}
+
+// writeJSONFile writes v as indented JSON, creating parent directories
+func writeJSONFile(dataPath string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dataPath, append(data, '\n'), 0o644)
+}
+
+func newHugoImage(entry *CacheEntry) HugoImage {
+	img := HugoImage{
+		Width:    entry.Width,
+		Height:   entry.Height,
+		Color:    entry.Color,
+		Taken:    entry.Taken,
+		Camera:   entry.Camera(),
+		Location: entry.Location,
+		Variants: make(map[string][]HugoVariant),
+	}
+
+	for _, objectPath := range entry.GCSPaths {
+		_, rung, format, ok := parseVariantPath(objectPath)
+		if !ok {
+			continue
+		}
+
+		img.Variants[format.Name] = append(img.Variants[format.Name], HugoVariant{
+			Rung:  rung.Name,
+			Width: variantWidth(entry, objectPath, rung),
+			URL:   publicBaseURL + "/" + objectPath,
+		})
+	}
+
+	// A custom ladder's rungs need not grow with every aspect ratio, so order
+	// by the variants' real size. Variants of an image share its aspect ratio,
+	// so one as wide as the variant before it is a copy (written before
+	// rungSizes left those out) and only the first in ladder order is kept.
+	for name, variants := range img.Variants {
+		sort.SliceStable(variants, func(i, j int) bool {
+			return variants[i].Width < variants[j].Width
+		})
+		img.Variants[name] = slices.CompactFunc(variants, func(a, b HugoVariant) bool {
+			return a.Width == b.Width
+		})
+	}
+
+	return img
+}
+
+// dominantColor returns the most common colour of an image as #rrggbb.
+// Pixels of a small thumbnail are grouped into coarse buckets and the
+// average of the fullest bucket is used.
+func dominantColor(img image.Image) string {
+	thumb := resize.Thumbnail(64, 64, img, resize.Bilinear)
+
+	type bucket struct {
+		r, g, b, n int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	bounds := thumb.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := thumb.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+
+			// 3 bits per channel
+			key := int(r>>5)<<6 | int(g>>5)<<3 | int(b>>5)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += int(r)
+			bk.g += int(g)
+			bk.b += int(b)
+			bk.n++
+
+			if best == nil || bk.n > best.n {
+				best = bk
+			}
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
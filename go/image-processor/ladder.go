@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rung is one size of the variant ladder. Its variants are stored as
+// images/<id><suffix>.<ext>, so the suffix of an existing rung must never change.
+//
+// The size is a target width, a target height, a bounding box (both) or a
+// target long edge. The rung with no suffix is the full-size original; its
+// size, if any, is a cap that larger originals are scaled down to.
+type Rung struct {
+	Name   string `json:"name"`
+	Suffix string `json:"suffix"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// LongEdge is the target length of the longer side, whatever the orientation
+	LongEdge int `json:"long_edge,omitempty"`
+	// Quality is the encoder quality (1-100), 0 for each format's default
+	Quality int `json:"quality,omitempty"`
+	// MaxBytes is a size budget per variant: quality is lowered as far as
+	// MinQuality (default minBudgetQuality) to stay within it. 0 for none.
+	MaxBytes   byteSize `json:"max_bytes,omitempty"`
+	MinQuality int      `json:"min_quality,omitempty"`
+	// Formats restricts the rung to some of --formats; JPEG is always written
+	Formats []string `json:"formats,omitempty"`
+}
+
+// minBudgetQuality is the lowest quality a size budget may push a rung to
+const minBudgetQuality = 40
+
+// defaultLadder keeps the suffixes of the original fixed widths (_0.._2 and
+// no suffix for the original) and adds a large-screen rung for the gallery.
+// The original is capped so readers never download a camera-sized file, and
+// gallery thumbnails are held to a size budget.
+//
+// Every rung is a bounding box containing the one before it, so each rung's
+// variant is at least as large as the last whatever the orientation. The
+// display rungs keep their widths for anything up to a 1:2 portrait; taller
+// ones are held to twice the width, never wider than a 960px column.
+var defaultLadder = []Rung{
+	{Name: "small", Suffix: "_0", Width: 240, Height: 480, MaxBytes: 15 * 1000},
+	{Name: "medium", Suffix: "_1", Width: 480, Height: 960},
+	{Name: "large", Suffix: "_2", Width: 960, Height: 1920},
+	{Name: "xlarge", Suffix: "_1920", Width: 1920, Height: 1920},
+	{Name: "original", Suffix: "", Width: 2560, Height: 2560},
+}
+
+// variantLadder is the ladder in use, from --ladder
+var variantLadder = defaultLadder
+
+var rungSuffixPattern = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// loadLadder reads a ladder from a JSON file: an array of rungs, smallest first
+func loadLadder(ladderPath string) ([]Rung, error) {
+	data, err := os.ReadFile(ladderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ladder []Rung
+	if err := json.Unmarshal(data, &ladder); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ladderPath, err)
+	}
+	if err := validateLadder(ladder); err != nil {
+		return nil, fmt.Errorf("invalid ladder in %s: %w", ladderPath, err)
+	}
+	return ladder, nil
+}
+
+// validateLadder checks that every variant name maps back to exactly one rung:
+// suffixes are unique and safe in object names, and exactly one rung, the
+// full-size one, has no suffix
+func validateLadder(ladder []Rung) error {
+	if len(ladder) == 0 {
+		return fmt.Errorf("no rungs")
+	}
+
+	names := make(map[string]bool)
+	suffixes := make(map[string]bool)
+	originals := 0
+	for _, rung := range ladder {
+		if rung.Name == "" {
+			return fmt.Errorf("rung with suffix %q has no name", rung.Suffix)
+		}
+		if names[rung.Name] {
+			return fmt.Errorf("duplicate rung name %q", rung.Name)
+		}
+		names[rung.Name] = true
+
+		if !rungSuffixPattern.MatchString(rung.Suffix) {
+			return fmt.Errorf("rung %q: suffix %q may only contain letters, digits, _ and -", rung.Name, rung.Suffix)
+		}
+		if suffixes[rung.Suffix] {
+			return fmt.Errorf("rung %q: duplicate suffix %q", rung.Name, rung.Suffix)
+		}
+		suffixes[rung.Suffix] = true
+
+		if rung.Width < 0 || rung.Height < 0 || rung.LongEdge < 0 {
+			return fmt.Errorf("rung %q: negative size", rung.Name)
+		}
+		if rung.LongEdge > 0 && (rung.Width > 0 || rung.Height > 0) {
+			return fmt.Errorf("rung %q: long_edge can't be combined with width or height", rung.Name)
+		}
+		if rung.isOriginal() {
+			originals++
+		} else if rung.Width == 0 && rung.Height == 0 && rung.LongEdge == 0 {
+			return fmt.Errorf("rung %q: needs a width, height or long_edge (only the full-size rung, with an empty suffix, may have none)", rung.Name)
+		}
+
+		if rung.Quality < 0 || rung.Quality > 100 {
+			return fmt.Errorf("rung %q: quality must be between 1 and 100", rung.Name)
+		}
+		if rung.MaxBytes < 0 {
+			return fmt.Errorf("rung %q: negative max_bytes", rung.Name)
+		}
+		if rung.MinQuality < 0 || rung.MinQuality > 100 {
+			return fmt.Errorf("rung %q: min_quality must be between 1 and 100", rung.Name)
+		}
+		if rung.MinQuality > 0 && rung.MaxBytes == 0 {
+			return fmt.Errorf("rung %q: min_quality only applies with max_bytes", rung.Name)
+		}
+		if rung.MinQuality > 0 && rung.Quality > 0 && rung.MinQuality > rung.Quality {
+			return fmt.Errorf("rung %q: min_quality is above quality", rung.Name)
+		}
+		for _, name := range rung.Formats {
+			if formatByName(strings.ToLower(name)) == nil {
+				return fmt.Errorf("rung %q: unknown image format %q", rung.Name, name)
+			}
+		}
+	}
+
+	if originals != 1 {
+		return fmt.Errorf("need exactly one full-size rung (empty suffix), found %d", originals)
+	}
+	return nil
+}
+
+// formats returns the formats the rung is written in: JPEG plus those of
+// formats the rung allows
+func (r *Rung) formats(formats []*ImageFormat) []*ImageFormat {
+	if len(r.Formats) == 0 {
+		return formats
+	}
+
+	var selected []*ImageFormat
+	for _, format := range formats {
+		if format == jpegFormat {
+			selected = append(selected, format)
+			continue
+		}
+		for _, name := range r.Formats {
+			if strings.EqualFold(name, format.Name) {
+				selected = append(selected, format)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// encode encodes a variant of the rung through encode, which takes a
+// quality, and returns the output and the quality chosen. Without a size
+// budget that is the rung's quality for the format; with one, the highest
+// quality down to the rung's minimum that fits the budget.
+func (r *Rung) encode(format *ImageFormat, encode func(quality int) ([]byte, error)) ([]byte, int, error) {
+	minQuality := r.MinQuality
+	if minQuality == 0 {
+		minQuality = minBudgetQuality
+	}
+	return encodeWithinBudget(format.Quality(r.Quality), minQuality, int64(r.MaxBytes), encode)
+}
+
+// isOriginal reports whether this is the full-size rung
+func (r *Rung) isOriginal() bool {
+	return r.Suffix == ""
+}
+
+// size returns the dimensions of the rung's variant of a width x height image
+// and whether the rung is written for it at all. Rungs that would not shrink
+// the image would only upscale it, so the full-size rung stands in for them;
+// the full-size rung itself is always written, capped to its size if it has
+// one but never smaller than another rung's variant. Unknown (0) dimensions
+// fit every rung.
+func (r *Rung) size(width, height int) (int, int, bool) {
+	if width == 0 || height == 0 || (r.Width == 0 && r.Height == 0 && r.LongEdge == 0) {
+		return width, height, true
+	}
+
+	var scale float64
+	switch {
+	case r.LongEdge > 0:
+		scale = float64(r.LongEdge) / float64(max(width, height))
+	case r.Width > 0 && r.Height > 0:
+		// Bounding box: whichever side hits its limit first
+		scale = min(float64(r.Width)/float64(width), float64(r.Height)/float64(height))
+	case r.Height > 0:
+		scale = float64(r.Height) / float64(height)
+	default:
+		scale = float64(r.Width) / float64(width)
+	}
+	if scale >= 1 {
+		return width, height, r.isOriginal()
+	}
+
+	newWidth := max(1, int(math.Round(float64(width)*scale)))
+	newHeight := max(1, int(math.Round(float64(height)*scale)))
+	if r.isOriginal() {
+		// A cap below another rung would make the full size the smaller one
+		for i := range variantLadder {
+			if variantLadder[i].isOriginal() {
+				continue
+			}
+			if w, h, ok := variantLadder[i].size(width, height); ok && w > newWidth {
+				newWidth, newHeight = w, h
+			}
+		}
+	}
+	return newWidth, newHeight, true
+}
+
+// rungSize is a rung written for an image and the size of its variant
+type rungSize struct {
+	rung          *Rung
+	width, height int
+}
+
+// rungSizes returns the rungs written for a width x height image, in ladder
+// order. A rung whose variant would be the same size as the one before it, as
+// the display rungs are for portraits taller than their boxes, or as the
+// full-size variant would only be a copy, so it is left out too. Unknown (0)
+// dimensions fit every rung.
+func rungSizes(width, height int) []rungSize {
+	full := originalRung()
+	fullWidth, fullHeight, _ := full.size(width, height)
+	known := width > 0 && height > 0
+
+	var sizes []rungSize
+	for i := range variantLadder {
+		rung := &variantLadder[i]
+		newWidth, newHeight, ok := rung.size(width, height)
+		if !ok {
+			continue
+		}
+		if known && rung != full {
+			if newWidth == fullWidth && newHeight == fullHeight {
+				continue
+			}
+			if last := len(sizes) - 1; last >= 0 && sizes[last].width == newWidth && sizes[last].height == newHeight {
+				continue
+			}
+		}
+		sizes = append(sizes, rungSize{rung: rung, width: newWidth, height: newHeight})
+	}
+	return sizes
+}
+
+// legacyRungWidths are the widths of the default rungs when they were sized by
+// width alone, before they became bounding boxes. Variants without a recorded
+// size were written then (see variantWidth).
+var legacyRungWidths = map[string]int{"_0": 240, "_1": 480, "_2": 960, "_1920": 1920}
+
+// variantWidth returns the width of an entry's variant of a rung: as recorded
+// when it was encoded, or else as the ladder it was written with made it.
+// Changing a rung's geometry leaves its existing objects as they were, so the
+// current ladder only sizes variants of rungs that are not in the old one.
+func variantWidth(entry *CacheEntry, objectPath string, rung *Rung) int {
+	if encoding, ok := entry.Encoding(objectPath); ok && encoding.Width > 0 {
+		return encoding.Width
+	}
+	if rung.isOriginal() {
+		return entry.Width
+	}
+	if width, ok := legacyRungWidths[rung.Suffix]; ok {
+		return min(width, entry.Width)
+	}
+	width, _, _ := rung.size(entry.Width, entry.Height)
+	return width
+}
+
+// originalRung returns the full-size rung of the ladder
+func originalRung() *Rung {
+	for i := range variantLadder {
+		if variantLadder[i].isOriginal() {
+			return &variantLadder[i]
+		}
+	}
+	return &variantLadder[len(variantLadder)-1]
+}
+
+// variantObjectPath returns the object path of a rung's variant in a format
+func variantObjectPath(id string, rung *Rung, format *ImageFormat) string {
+	return fmt.Sprintf("%s/%s%s.%s", gcsImagePath, id, rung.Suffix, format.Extension)
+}
+
+// variantObjectPaths returns the object paths of every rung that fits an image
+// of the given dimensions (0 if unknown) in the given formats, in the order
+// uploadImageVariants records them
+func variantObjectPaths(id string, width, height int, formats []*ImageFormat) []string {
+	var paths []string
+	for _, size := range rungSizes(width, height) {
+		for _, format := range size.rung.formats(formats) {
+			paths = append(paths, variantObjectPath(id, size.rung, format))
+		}
+	}
+	return paths
+}
+
+// parseVariantPath splits a variant object name (with or without the image
+// prefix) into its base name, rung and format. Names without a known suffix
+// belong to the full-size rung.
+func parseVariantPath(objectPath string) (base string, rung *Rung, format *ImageFormat, ok bool) {
+	name := path.Base(objectPath)
+	ext := path.Ext(name)
+	format = formatByExtension(ext)
+	if format == nil {
+		return "", nil, nil, false
+	}
+
+	base = strings.TrimSuffix(name, ext)
+	// Longest suffixes first, in case one suffix ends with another
+	rungs := make([]*Rung, 0, len(variantLadder))
+	for i := range variantLadder {
+		if variantLadder[i].Suffix != "" {
+			rungs = append(rungs, &variantLadder[i])
+		}
+	}
+	sort.SliceStable(rungs, func(i, j int) bool {
+		return len(rungs[i].Suffix) > len(rungs[j].Suffix)
+	})
+	for _, rung := range rungs {
+		if strings.HasSuffix(base, rung.Suffix) && len(base) > len(rung.Suffix) {
+			return strings.TrimSuffix(base, rung.Suffix), rung, format, true
+		}
+	}
+	return base, originalRung(), format, true
+}
+
+// Rungs returns the names of the rungs an entry has variants for, in ladder
+// order. Rungs the original was too small for are not among them.
+func (e *CacheEntry) Rungs() []string {
+	have := make(map[*Rung]bool)
+	for _, objectPath := range e.GCSPaths {
+		if _, rung, _, ok := parseVariantPath(objectPath); ok {
+			have[rung] = true
+		}
+	}
+
+	var names []string
+	for i := range variantLadder {
+		if have[&variantLadder[i]] {
+			names = append(names, variantLadder[i].Name)
+		}
+	}
+	return names
+}
+
+func extractBaseFilename(filename string) string {
+	base, _, _, ok := parseVariantPath(filename)
+	if !ok {
+		return filename
+	}
+	return base + ".jpeg"
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/devhou-se/www-jp/go/utils"
+)
+
+// Object layouts, selected with --layout
+const (
+	// layoutName keys the cache by filename and names objects after the
+	// last path segment of the source URL
+	layoutName = "name"
+	// layoutContent keys the cache by full source URL (or local path) and names
+	// objects after the SHA256 of the original, so identical images are stored once
+	layoutContent = "content"
+)
+
+// objectLayout is the layout used for newly processed images
+var objectLayout = layoutName
+
+func parseLayout(layout string) (string, error) {
+	switch layout {
+	case layoutName, layoutContent:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("unknown layout %q (expected %s or %s)", layout, layoutName, layoutContent)
+	}
+}
+
+// isLocalImage reports whether a source or cache key is an image on disk, such
+// as site/content/posts/a/cover.jpg. Web sources are URLs, and name-layout keys
+// are bare filenames.
+func isLocalImage(key string) bool {
+	return strings.Contains(filepath.ToSlash(key), "/") &&
+		!strings.HasPrefix(key, "http://") && !strings.HasPrefix(key, "https://")
+}
+
+// cacheKey returns the cache key for an image source under the current layout.
+// Local images are always keyed by path: page bundles often share filenames
+// like cover.jpg.
+func cacheKey(source string) string {
+	if objectLayout == layoutContent || isLocalImage(source) {
+		return source
+	}
+	return utils.ImageFilename(source)
+}
+
+// lookupEntry finds the cache entry for an image source. Under the content
+// layout, entries created with the name layout are still honoured so switching
+// layouts does not reprocess everything. Local images only match their path.
+func lookupEntry(cache *ImageCache, source string) (*CacheEntry, bool) {
+	if entry, ok := cache.Get(cacheKey(source)); ok || isLocalImage(source) {
+		return entry, ok
+	}
+	return cache.Get(utils.ImageFilename(source))
+}
+
+// newObjectID returns the ID new variants are named after. Local images are
+// named by hash under either layout, as their paths can't name an object.
+func newObjectID(key, hash string) string {
+	if objectLayout == layoutContent || isLocalImage(key) {
+		return hash
+	}
+	return utils.ImageID(key)
+}
+
+// ObjectID returns the ID an entry's variants are named after, i.e. the
+// images/<id>_N.jpeg part shared by all of them. It is taken from the recorded
+// paths so entries from either layout resolve correctly; legacy entries without
+// paths always used the name layout.
+func (e *CacheEntry) ObjectID() string {
+	for _, objectPath := range e.GCSPaths {
+		if base, _, _, ok := parseVariantPath(objectPath); ok {
+			return base
+		}
+	}
+	return utils.ImageID(e.Filename)
+}
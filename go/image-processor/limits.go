@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// bytesPerPixel is the in-memory size of a decoded RGBA pixel
+const bytesPerPixel = 4
+
+// imageMemory is the budget shared by all workers, sized by --memory-budget
+var imageMemory = newMemoryBudget(2 << 30)
+
+var (
+	// maxImagePixels is the largest image, in pixels, that will be decoded.
+	// Decoding allocates for the dimensions in the header whatever the file
+	// size, so a small file can claim to be enormous.
+	maxImagePixels int64 = 150_000_000
+
+	errTooManyPixels = permanent(errors.New("image dimensions too large"))
+)
+
+// checkImagePixels fails with errTooManyPixels if a width x height image is
+// over maxImagePixels (0 or less for no limit)
+func checkImagePixels(width, height int) error {
+	if maxImagePixels > 0 && int64(width)*int64(height) > maxImagePixels {
+		return fmt.Errorf("%w: %dx%d (limit %d pixels)", errTooManyPixels, width, height, maxImagePixels)
+	}
+	return nil
+}
+
+// memoryBudget throttles workers by the estimated memory of the images they
+// hold, so a few huge originals can't exhaust the machine. A limit of 0 or
+// less disables it.
+type memoryBudget struct {
+	sem   *semaphore.Weighted
+	limit int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return &memoryBudget{}
+	}
+	return &memoryBudget{sem: semaphore.NewWeighted(limit), limit: limit}
+}
+
+// Acquire blocks until n bytes of the budget are free and returns the amount
+// to pass to Release. A request larger than the whole budget waits until
+// nothing else is held and then runs alone.
+func (b *memoryBudget) Acquire(ctx context.Context, n int64) (int64, error) {
+	if b.sem == nil {
+		return 0, nil
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	if err := b.sem.Acquire(ctx, n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Release returns n bytes to the budget
+func (b *memoryBudget) Release(n int64) {
+	if b.sem == nil || n == 0 {
+		return
+	}
+	b.sem.Release(n)
+}
+
+// estimateImageMemory returns the rough peak memory of processing an image:
+// the decoded original, the RGBA copy and destination applyOrientation makes,
+// and the rungs, which are all resized at once, plus whatever of the original
+// file is held in memory. Orientation is only known once decoded, so it is
+// always counted, and each rung is sized for whichever way up is larger.
+func estimateImageMemory(width, height int, blob *imageBlob) int64 {
+	pixels := int64(width) * int64(height) * 3
+	for i := range variantLadder {
+		pixels += max(resizePixels(&variantLadder[i], width, height), resizePixels(&variantLadder[i], height, width))
+	}
+	return pixels*bytesPerPixel + blob.InMemory()
+}
+
+// resizePixels returns the pixels allocated resizing an image to a rung: the
+// output and an intermediate as tall as the image and as wide as the output
+func resizePixels(rung *Rung, width, height int) int64 {
+	newWidth, newHeight, ok := rung.size(width, height)
+	if !ok {
+		return 0
+	}
+	return int64(newWidth) * (int64(height) + int64(newHeight))
+}
+
+// byteSize is a flag value for sizes like "512MiB", "2GB" or "1048576"
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	// Longest suffixes first so "MiB" isn't matched as "B"
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+func (s *byteSize) String() string {
+	n := int64(*s)
+	// Largest binary unit that divides evenly
+	for i := 2; i >= 0; i-- {
+		if unit := byteUnits[i]; n != 0 && n%unit.scale == 0 {
+			return strconv.FormatInt(n/unit.scale, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	value = strings.TrimSpace(value)
+	scale := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(value), strings.ToUpper(unit.suffix)) {
+			value = strings.TrimSpace(value[:len(value)-len(unit.suffix)])
+			scale = unit.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*s = byteSize(n * scale)
+	return nil
+}
+
+// UnmarshalJSON accepts a size as a number of bytes or a string like "15KB"
+func (s *byteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*s = byteSize(n)
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid size %s", data)
+	}
+	return s.Set(value)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Log formats for --log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// stdout carries both the log and, on a terminal, the progress line
+var stdout = newConsole(os.Stdout)
+
+// setupLogging installs the default slog logger writing to stdout in the given
+// format, at debug level with --verbose and info otherwise
+func setupLogging(format string, verbose bool) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if verbose {
+		opts.Level = slog.LevelDebug
+	}
+
+	var handler slog.Handler
+	switch format {
+	case logFormatText:
+		handler = slog.NewTextHandler(stdout, opts)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(stdout, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (expected %s or %s)", format, logFormatText, logFormatJSON)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// console serializes writes to a stream and the progress line drawn on it.
+// The progress line is only drawn on a terminal and is cleared before
+// anything else is written, so log records never run into it.
+type console struct {
+	mu       sync.Mutex
+	w        io.Writer
+	terminal bool
+	status   bool // The progress line is on screen
+}
+
+func newConsole(f *os.File) *console {
+	return &console{w: f, terminal: isTerminal(f)}
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clearStatus()
+	return c.w.Write(p)
+}
+
+// Terminal reports whether the stream is a terminal
+func (c *console) Terminal() bool {
+	return c.terminal
+}
+
+// SetStatus replaces the progress line, if the stream is a terminal
+func (c *console) SetStatus(line string) {
+	if !c.terminal {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clearStatus()
+	fmt.Fprint(c.w, line)
+	c.status = true
+}
+
+// ClearStatus removes the progress line
+func (c *console) ClearStatus() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clearStatus()
+}
+
+func (c *console) clearStatus() {
+	if c.status {
+		// Return to the start of the line and erase it
+		fmt.Fprint(c.w, "\r\033[K")
+		c.status = false
+	}
+}
+
+// isTerminal reports whether f is a character device such as a terminal,
+// rather than a pipe or file as in CI
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
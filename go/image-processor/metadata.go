@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+)
+
+// EXIF tags read into the cache
+const (
+	makeTagID               = 0x010f
+	modelTagID              = 0x0110
+	dateTimeOriginalTagID   = 0x9003
+	offsetTimeOriginalTagID = 0x9011
+)
+
+// exifDateTimeLayout is the EXIF timestamp format, in the camera's local time
+const exifDateTimeLayout = "2006:01:02 15:04:05"
+
+// gpsPrecision is the number of decimal places GPS coordinates are rounded to
+// before they are recorded (2 is roughly 1 km), or negative to not record them
+var gpsPrecision = 2
+
+// Location is a coarsened GPS position
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// String formats the location as "lat,lon" for the cache file
+func (l *Location) String() string {
+	return strconv.FormatFloat(l.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(l.Lon, 'f', -1, 64)
+}
+
+func parseLocation(value string) (*Location, error) {
+	latStr, lonStr, ok := strings.Cut(value, ",")
+	if !ok {
+		return nil, fmt.Errorf("invalid location %q", value)
+	}
+	lat, err := strconv.ParseFloat(latStr, 64)
+	if err != nil {
+		return nil, err
+	}
+	lon, err := strconv.ParseFloat(lonStr, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Location{Lat: lat, Lon: lon}, nil
+}
+
+// applyExifMetadata copies capture time, camera and coarsened location from
+// an image's parsed EXIF into its cache entry
+func applyExifMetadata(entry *CacheEntry, rootIfd *exif.Ifd) {
+	entry.CameraMake = exifString(rootIfd, makeTagID)
+	entry.CameraModel = exifString(rootIfd, modelTagID)
+
+	if exifIfd, err := rootIfd.ChildWithIfdPath(exifcommon.IfdExifStandardIfdIdentity); err == nil {
+		entry.Taken = captureTime(exifString(exifIfd, dateTimeOriginalTagID), exifString(exifIfd, offsetTimeOriginalTagID))
+	}
+
+	if gi := exifGPS(rootIfd); gi != nil {
+		entry.GPS = true
+		if gpsPrecision >= 0 {
+			entry.Location = &Location{
+				Lat: coarsen(gi.Latitude.Decimal(), gpsPrecision),
+				Lon: coarsen(gi.Longitude.Decimal(), gpsPrecision),
+			}
+		}
+	}
+}
+
+// exifString returns an ASCII tag as a string safe to store in the cache
+// file, or "" if the tag is missing
+func exifString(ifd *exif.Ifd, tagID uint16) string {
+	results, err := ifd.FindTagWithId(tagID)
+	if err != nil || len(results) == 0 {
+		return ""
+	}
+	value, err := results[0].Value()
+	if err != nil {
+		return ""
+	}
+	s, ok := value.(string)
+	if !ok {
+		return ""
+	}
+	// | separates cache fields and a line break would split the cache line,
+	// so both become spaces, as does any other control character. Cameras
+	// pad with NULs and spaces.
+	s = strings.Map(func(r rune) rune {
+		if r == '|' || unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// captureTime converts an EXIF DateTimeOriginal to RFC 3339. Without an
+// OffsetTimeOriginal the zone is unknown and left off.
+func captureTime(dateTime, offset string) string {
+	t, err := time.Parse(exifDateTimeLayout, dateTime)
+	if err != nil {
+		return ""
+	}
+	if zoned, err := time.Parse(exifDateTimeLayout+"-07:00", dateTime+offset); err == nil && offset != "" {
+		return zoned.Format(time.RFC3339)
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+func coarsen(value float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(value*scale) / scale
+}
+
+// Camera returns a display name for the camera, e.g. "Samsung SM-S911B".
+// Many models already start with the make, so it is not repeated.
+func (e *CacheEntry) Camera() string {
+	if e.CameraMake == "" || strings.HasPrefix(strings.ToLower(e.CameraModel), strings.ToLower(e.CameraMake)) {
+		return e.CameraModel
+	}
+	if e.CameraModel == "" {
+		return e.CameraMake
+	}
+	return e.CameraMake + " " + e.CameraModel
+}
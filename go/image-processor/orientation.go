@@ -0,0 +1,101 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/dsoprea/go-exif/v3"
+)
+
+// orientationTagID is the EXIF Orientation tag in IFD0
+const orientationTagID = 0x0112
+
+// Orientation values as defined by the EXIF spec
+const (
+	orientationNormal     = 1
+	orientationFlipH      = 2
+	orientationRotate180  = 3
+	orientationFlipV      = 4
+	orientationTranspose  = 5
+	orientationRotate90   = 6
+	orientationTransverse = 7
+	orientationRotate270  = 8
+)
+
+// exifOrientation returns the Orientation tag of a parsed EXIF block, or
+// orientationNormal if the tag is missing or invalid
+func exifOrientation(rootIfd *exif.Ifd) int {
+	results, err := rootIfd.FindTagWithId(orientationTagID)
+	if err != nil || len(results) == 0 {
+		return orientationNormal
+	}
+
+	value, err := results[0].Value()
+	if err != nil {
+		return orientationNormal
+	}
+
+	values, ok := value.([]uint16)
+	if !ok || len(values) == 0 || values[0] < orientationNormal || values[0] > orientationRotate270 {
+		return orientationNormal
+	}
+	return int(values[0])
+}
+
+// resetOrientation marks an EXIF block as upright so viewers that honour the
+// tag don't transform already normalised pixels a second time
+func resetOrientation(ib *exif.IfdBuilder) error {
+	return ib.SetStandard(orientationTagID, []uint16{orientationNormal})
+}
+
+// applyOrientation returns img rotated and flipped so it displays upright
+// without any EXIF Orientation tag
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation == orientationNormal {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	// Orientations 5-8 swap the axes
+	dstW, dstH := w, h
+	if orientation >= orientationTranspose {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			// Source pixel that ends up at (x, y)
+			var sx, sy int
+			switch orientation {
+			case orientationFlipH:
+				sx, sy = w-1-x, y
+			case orientationRotate180:
+				sx, sy = w-1-x, h-1-y
+			case orientationFlipV:
+				sx, sy = x, h-1-y
+			case orientationTranspose:
+				sx, sy = y, x
+			case orientationRotate90:
+				sx, sy = y, h-1-x
+			case orientationTransverse:
+				sx, sy = w-1-y, h-1-x
+			case orientationRotate270:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
@@ -3,33 +3,37 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
-	"image/jpeg"
 	_ "image/png" // Register PNG decoder
-	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/dsoprea/go-exif/v3"
 	jis "github.com/dsoprea/go-jpeg-image-structure/v2"
 	"github.com/nfnt/resize"
 	"golang.org/x/sync/semaphore"
-	"google.golang.org/api/iterator"
 
 	"github.com/devhou-se/www-jp/go/utils"
 )
 
 const (
-	gcsBucketName = "static.devh.se"
-	gcsImagePath  = "images"
-	maxRetries    = 3
-	baseBackoff   = 1 * time.Second
+	gcsBucketName    = "static.devh.se"
+	gcsImagePath     = "images"
+	staticDirectory  = "static"  // Relative to utils.SiteDirectory
+	contentDirectory = "content" // Relative to utils.SiteDirectory
+	maxRetries       = 3
+	baseBackoff      = 1 * time.Second
 )
 
 var (
@@ -42,63 +46,151 @@ var (
 		},
 	}
 
-	imageWidths = []int{240, 480, 960, 0}
+	// variantFormats are the encodings written for every rung, resolved from --formats
+	variantFormats = []*ImageFormat{jpegFormat}
 )
 
 // Config holds processor configuration
 type Config struct {
-	RebuildCache   bool
-	Parallelism    int
-	Verbose        bool
-	VerifyCache    bool
-	DryRun         bool
-	MaintenanceOp  string
+	RebuildCache     bool
+	Parallelism      int
+	Verbose          bool
+	VerifyCache      bool
+	DryRun           bool
+	MaintenanceOp    string
+	Store            string
+	StoreDir         string
+	Formats          string
+	ExportFormat     string
+	ExportOut        string
+	HugoData         string
+	GCPlan           string
+	GCGrace          time.Duration
+	Layout           string
+	ExifPolicy       string
+	GPSPrecision     int
+	HugoLocations    string
+	MaxImageBytes    byteSize
+	MaxPixels        int64
+	SpillBytes       byteSize
+	MemoryBudget     byteSize
+	BreakerThreshold int
+	Revalidate       bool
+	Reprocess        reprocessPatterns
+	Report           string
+	LogFormat        string
+	Ladder           string
+	ArchivePrefix    string
+	ArchiveBucket    string
 }
 
 func main() {
 	// Parse flags
 	config := parseFlags()
 
-	ctx := context.Background()
+	if err := setupLogging(config.LogFormat, config.Verbose); err != nil {
+		slog.Error("invalid --log-format", "error", err)
+		os.Exit(1)
+	}
 
-	// Initialize GCS client
-	gcsClient, err := storage.NewClient(ctx)
+	// Cancelled on Ctrl-C or when a deploy is cancelled, stopping in-flight work
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	formats, err := parseFormats(config.Formats)
 	if err != nil {
-		fmt.Printf("❌ Failed to create GCS client: %v\n", err)
+		slog.Error("invalid --formats", "error", err)
 		os.Exit(1)
 	}
-	defer gcsClient.Close()
+	variantFormats = formats
 
-	bucket := gcsClient.Bucket(gcsBucketName)
+	if config.Ladder != "" {
+		ladder, err := loadLadder(config.Ladder)
+		if err != nil {
+			slog.Error("invalid --ladder", "error", err)
+			os.Exit(1)
+		}
+		variantLadder = ladder
+	}
+
+	prefix, err := parseArchivePrefix(config.ArchivePrefix)
+	if err != nil {
+		slog.Error("invalid --archive-prefix", "error", err)
+		os.Exit(1)
+	}
+	archivePrefix = prefix
+
+	layout, err := parseLayout(config.Layout)
+	if err != nil {
+		slog.Error("invalid --layout", "error", err)
+		os.Exit(1)
+	}
+	objectLayout = layout
+
+	policy, err := parseExifPolicy(config.ExifPolicy)
+	if err != nil {
+		slog.Error("invalid --exif-policy", "error", err)
+		os.Exit(1)
+	}
+	exifPolicy = policy
+	gpsPrecision = config.GPSPrecision
+	maxImageBytes = int64(config.MaxImageBytes)
+	maxImagePixels = config.MaxPixels
+	spillThreshold = int64(config.SpillBytes)
+	imageMemory = newMemoryBudget(int64(config.MemoryBudget))
+	hostBreaker = newCircuitBreaker(config.BreakerThreshold)
+
+	// Initialize object stores. The archive is checked first, as it must not
+	// be the public image bucket.
+	archive, closeArchive, err := openArchiveStore(ctx, config)
+	if err != nil {
+		slog.Error("failed to open archive store", "error", err)
+		os.Exit(1)
+	}
+	defer closeArchive()
+	archiveStore = archive
+
+	store, closeStore, err := openStore(ctx, config)
+	if err != nil {
+		slog.Error("failed to open store", "error", err)
+		os.Exit(1)
+	}
+	defer closeStore()
 
 	// Initialize cache
 	cache := NewImageCache()
 	if err := cache.Load(); err != nil {
-		fmt.Printf("❌ Failed to load cache: %v\n", err)
+		slog.Error("failed to load cache", "error", err)
 		os.Exit(1)
 	}
 
 	// Handle different operations
 	switch {
 	case config.RebuildCache:
-		if err := rebuildCacheFromGCS(ctx, bucket, cache); err != nil {
-			fmt.Printf("❌ Failed to rebuild cache: %v\n", err)
+		if err := rebuildCacheFromGCS(ctx, store, cache); err != nil {
+			slog.Error("failed to rebuild cache", "error", err)
 			os.Exit(1)
 		}
 		return
 
 	case config.VerifyCache:
-		verifyCacheIntegrity(ctx, bucket, cache)
+		if err := verifyCacheIntegrity(ctx, store, cache); err != nil {
+			slog.Error("verification failed", "error", err)
+			os.Exit(1)
+		}
 		return
 
 	case config.MaintenanceOp != "":
-		handleMaintenance(ctx, bucket, cache, config)
+		if err := handleMaintenance(ctx, store, cache, config); err != nil {
+			slog.Error("maintenance failed", "error", err)
+			os.Exit(1)
+		}
 		return
 	}
 
 	// Normal processing mode
-	if err := processImages(ctx, bucket, cache, config); err != nil {
-		fmt.Printf("❌ Processing failed: %v\n", err)
+	if err := processImages(ctx, store, cache, config); err != nil {
+		slog.Error("processing failed", "error", err)
 		os.Exit(1)
 	}
 }
@@ -106,43 +198,95 @@ func main() {
 func parseFlags() *Config {
 	config := &Config{}
 
-	flag.BoolVar(&config.RebuildCache, "rebuild-cache", false, "Rebuild cache from GCS")
+	flag.BoolVar(&config.RebuildCache, "rebuild-cache", false, "Rebuild cache from the object store")
 	flag.BoolVar(&config.VerifyCache, "verify-cache", false, "Verify cache integrity")
+	flag.Var(&config.Reprocess, "reprocess", "Reprocess and overwrite images by filename, ID, source, post path or glob (comma-separated or repeated)")
+	flag.BoolVar(&config.Revalidate, "revalidate", false, "Check cached images against their source and reprocess those that changed")
 	flag.IntVar(&config.Parallelism, "parallelism", 20, "Number of concurrent image processors")
+	flag.IntVar(&config.BreakerThreshold, "breaker-threshold", hostBreaker.threshold, "Consecutive failures from a host before its downloads fail fast (0 to disable)")
+	config.MaxImageBytes = byteSize(maxImageBytes)
+	flag.Var(&config.MaxImageBytes, "max-image-size", "Largest original to fetch, e.g. 200MiB")
+	flag.Int64Var(&config.MaxPixels, "max-pixels", maxImagePixels, "Largest image to decode, in pixels (0 for no limit)")
+	config.SpillBytes = byteSize(spillThreshold)
+	flag.Var(&config.SpillBytes, "spill-size", "Originals larger than this are buffered in a temp file instead of memory")
+	config.MemoryBudget = byteSize(imageMemory.limit)
+	flag.Var(&config.MemoryBudget, "memory-budget", "Estimated memory all workers may hold for decoded images (0 for no limit)")
 	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose logging")
+	flag.StringVar(&config.LogFormat, "log-format", logFormatText, "Log format: text or json")
 	flag.BoolVar(&config.DryRun, "dry-run", false, "Don't upload images, just show what would be done")
-	flag.StringVar(&config.MaintenanceOp, "maintenance", "", "Maintenance operation: stats, export, repair")
+	flag.StringVar(&config.MaintenanceOp, "maintenance", "", "Maintenance operation: stats, export, repair, gc, hugo-data")
+	flag.StringVar(&config.ExportFormat, "export-format", "json", "Export format for --maintenance export: json, csv, jsonl")
+	flag.StringVar(&config.ExportOut, "out", "", "Output file for --maintenance export")
+	flag.StringVar(&config.HugoData, "hugo-data", "site/data/images.json", "Path of the Hugo image data file (empty to disable)")
+	flag.StringVar(&config.HugoLocations, "hugo-locations", "site/data/locations.json", "Path of the Hugo photo locations data file (empty to disable)")
+	flag.StringVar(&config.Report, "report", "", "Write a JSON report of the run (counts, timings, bytes, variants, errors) to this path")
+	flag.StringVar(&config.GCPlan, "gc-plan", "imager-gc-plan.txt", "Plan file written by --maintenance gc --dry-run and required to delete")
+	flag.DurationVar(&config.GCGrace, "gc-grace", 30*24*time.Hour, "Keep unreferenced images processed more recently than this")
+	flag.StringVar(&config.Store, "store", "gcs", "Object store backend: gcs, local, memory")
+	flag.StringVar(&config.StoreDir, "store-dir", "", "Root directory for the local object store")
+	flag.StringVar(&config.Layout, "layout", layoutName, "Object naming for new images: name (from the URL) or content (SHA256 of the original)")
+	flag.StringVar(&config.ExifPolicy, "exif-policy", exifPolicyAllowlist, "EXIF written to JPEG variants: keep, strip-gps or allowlist")
+	flag.IntVar(&config.GPSPrecision, "gps-precision", 2, "Decimal places GPS positions are rounded to in the cache (negative to not record them)")
+	flag.StringVar(&config.Ladder, "ladder", "", "JSON file defining the variant ladder (default: built-in 240/480/960/1920/original capped at 2560)")
+	flag.StringVar(&config.ArchivePrefix, "archive-prefix", "", "Also store each original unmodified under this prefix of --archive-bucket, e.g. originals (empty to disable)")
+	flag.StringVar(&config.ArchiveBucket, "archive-bucket", "", "Private bucket for archived originals, never the public image bucket (a directory with --store local)")
+	flag.StringVar(&config.Formats, "formats", "jpeg,webp,avif", "Comma-separated variant formats (JPEG is always written)")
 
 	flag.Parse()
 	return config
 }
 
-func processImages(ctx context.Context, bucket *storage.BucketHandle, cache *ImageCache, config *Config) error {
-	// Get all web images from markdown files
-	images, err := utils.WebImages()
+func processImages(ctx context.Context, store ObjectStore, cache *ImageCache, config *Config) error {
+	// Get all web and local images from markdown files
+	images, err := utils.Images()
 	if err != nil {
 		return fmt.Errorf("failed to get images: %w", err)
 	}
 
 	if len(images) == 0 {
-		fmt.Println("✓ No images to process")
+		slog.Info("no images to process")
 		return nil
 	}
 
-	fmt.Printf("Found %d images in markdown files\n", len(images))
+	slog.Info("found images in markdown files", "count", len(images))
 
-	// Filter uncached images
-	uncachedImages, cachedCount := filterUncachedImages(images, cache, config)
+	// Filter uncached images, plus those selected by --reprocess
+	reprocess := newReprocessMatcher(config.Reprocess)
+	tasks, cachedCount := filterUncachedImages(images, cache, config, reprocess)
+	// Images linked from several posts count once
+	found := len(tasks) + cachedCount
 
-	fmt.Printf("Cached: %d | To process: %d\n\n", cachedCount, len(uncachedImages))
+	forcedIDs := make(map[string]bool)
+	for _, task := range tasks {
+		if entry, ok := lookupEntry(cache, task.source()); ok && task.force {
+			forcedIDs[entry.ObjectID()] = true
+		}
+	}
+	lazyTasks, err := lazyReprocessTasks(cache, reprocess, forcedIDs)
+	if err != nil {
+		return err
+	}
+	tasks = append(tasks, lazyTasks...)
 
-	if len(uncachedImages) == 0 {
-		fmt.Println("✓ All images are cached, nothing to process")
-		return cache.Save()
+	for _, pattern := range reprocess.Unmatched() {
+		slog.Warn("--reprocess pattern matched no images", "pattern", pattern)
 	}
 
+	slog.Info("filtered cached images", "cached", cachedCount, "to_process", len(tasks))
+
 	// Initialize progress tracker
-	progress := NewProgressTracker(len(uncachedImages))
+	progress := NewProgressTracker(len(tasks))
+
+	if len(tasks) == 0 {
+		slog.Info("all images are cached, nothing to process")
+		if err := cache.Save(); err != nil {
+			return err
+		}
+		if err := updateHugoData(cache, config); err != nil {
+			return err
+		}
+		return writeRunReport(ctx, progress, config, found, cachedCount)
+	}
 
 	// Process images concurrently
 	sem := semaphore.NewWeighted(int64(config.Parallelism))
@@ -164,38 +308,47 @@ func processImages(ctx context.Context, bucket *storage.BucketHandle, cache *Ima
 		}
 	}()
 
-	for _, img := range uncachedImages {
+	for _, task := range tasks {
 		wg.Add(1)
-		img := img // Capture loop variable
+		task := task // Capture loop variable
 
 		go func() {
 			defer wg.Done()
 
+			source := task.source()
+			filename := task.name()
+			report := progress.StartImage(filename, source)
+
 			if err := sem.Acquire(ctx, 1); err != nil {
-				progress.AddError(extractFilename(img.WebLocation), img.WebLocation, err)
+				progress.FinishImage(report, err)
 				return
 			}
 			defer sem.Release(1)
 
-			filename := extractFilename(img.WebLocation)
 			progress.SetCurrent(filename)
 
 			if config.DryRun {
-				fmt.Printf("DRY RUN: Would process %s\n", filename)
-				progress.IncrementSkipped()
+				slog.Info("dry run, would process image", "filename", filename, "url", source)
+				report.Skip("dry run")
+				progress.FinishImage(report, nil)
 				return
 			}
 
-			if err := processImage(ctx, bucket, cache, img, fl, progress); err != nil {
-				progress.AddError(filename, img.WebLocation, err)
+			if task.entry != nil {
+				err := repairEntry(ctx, store, cache, task.entry, source, true, fl, report)
+				progress.FinishImage(report, err)
+				return
 			}
+
+			progress.FinishImage(report, processImage(ctx, store, cache, task, fl, report))
 		}()
 	}
 
 	wg.Wait()
 	done <- true
 
-	// Print final summary
+	// Print final summary in place of the progress line
+	stdout.ClearStatus()
 	progress.PrintSummary()
 
 	// Save cache
@@ -203,7 +356,19 @@ func processImages(ctx context.Context, bucket *storage.BucketHandle, cache *Ima
 		if err := cache.Save(); err != nil {
 			return fmt.Errorf("failed to save cache: %w", err)
 		}
-		fmt.Println("\n✓ Cache saved successfully")
+		slog.Info("cache saved", "entries", cache.Size())
+
+		if err := updateHugoData(cache, config); err != nil {
+			return fmt.Errorf("failed to write hugo data: %w", err)
+		}
+	}
+
+	if err := writeRunReport(ctx, progress, config, found, cachedCount); err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted, progress so far was saved: %w", ctx.Err())
 	}
 
 	// Return error if any processing failed
@@ -214,211 +379,346 @@ func processImages(ctx context.Context, bucket *storage.BucketHandle, cache *Ima
 	return nil
 }
 
-func filterUncachedImages(images []utils.Image, cache *ImageCache, config *Config) ([]utils.Image, int) {
-	uncached := make([]utils.Image, 0, len(images))
+// writeRunReport writes the --report file, if one was asked for
+func writeRunReport(ctx context.Context, progress *ProgressTracker, config *Config, found, cached int) error {
+	if config.Report == "" {
+		return nil
+	}
+
+	report := progress.Report(found, cached)
+	report.DryRun = config.DryRun
+	report.Interrupted = ctx.Err() != nil
+	if err := writeJSONFile(config.Report, report); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	slog.Info("wrote run report", "path", config.Report)
+	return nil
+}
+
+// imageTask is an image to process and how
+type imageTask struct {
+	img utils.Image
+	// entry is set instead of img for images only embedded with the lazyimage
+	// shortcode, which are regenerated like a repair
+	entry *CacheEntry
+
+	revalidate bool // Conditional request against the cached validators
+	force      bool // Reprocess and overwrite variants even if unchanged
+}
+
+// source returns where the task's original is fetched from, "" if only the
+// stored original is available
+func (t imageTask) source() string {
+	if t.entry != nil {
+		return entrySource(t.entry)
+	}
+	return imageSource(t.img)
+}
+
+// name returns the filename shown in progress and errors
+func (t imageTask) name() string {
+	if t.entry != nil {
+		return utils.ImageFilename(t.entry.Filename)
+	}
+	return utils.ImageFilename(t.source())
+}
+
+// filterUncachedImages returns tasks for images not in the cache, cached images
+// when revalidating and images selected by --reprocess, and the number of
+// cached images left out. Both count sources, not links: an image linked from
+// several posts gets a single task, forced if --reprocess selects any of them.
+func filterUncachedImages(images []utils.Image, cache *ImageCache, config *Config, reprocess *reprocessMatcher) ([]imageTask, int) {
+	tasks := make([]imageTask, 0, len(images))
 	cachedCount := 0
+	// Index of each source's task, -1 for cached sources
+	seen := make(map[string]int)
 
 	for _, img := range images {
-		filename := extractFilename(img.WebLocation)
+		source := imageSource(img)
+		filename := utils.ImageFilename(source)
+		force := reprocess.MatchImage(img, cache)
+
+		if i, ok := seen[source]; ok {
+			switch {
+			case !force:
+			case i < 0:
+				cachedCount--
+				seen[source] = len(tasks)
+				tasks = append(tasks, imageTask{img: img, force: true})
+			case !tasks[i].force:
+				tasks[i] = imageTask{img: img, force: true}
+			}
+			continue
+		}
+		seen[source] = len(tasks)
+
+		if force {
+			tasks = append(tasks, imageTask{img: img, force: true})
+			continue
+		}
 
 		// Check if image is in cache
 		// Legacy entries (from v1.0) have no hash, but we still trust them
 		// since they indicate the image was uploaded to GCS
-		if cache.Has(filename) {
-			cachedCount++
-			if config.Verbose {
-				entry, _ := cache.Get(filename)
-				if entry.Hash == "" {
-					fmt.Printf("⊙ Cached (legacy): %s\n", filename)
-				} else {
-					fmt.Printf("⊙ Cached: %s\n", filename)
-				}
+		if entry, ok := lookupEntry(cache, source); ok {
+			if config.Revalidate {
+				// Checked against the source in processImage
+				tasks = append(tasks, imageTask{img: img, revalidate: true})
+				continue
 			}
+			cachedCount++
+			seen[source] = -1
+			slog.Debug("cached", "filename", filename, "url", source, "legacy", isLegacyEntry(entry))
 			continue
 		}
 
-		uncached = append(uncached, img)
+		tasks = append(tasks, imageTask{img: img})
 	}
 
-	return uncached, cachedCount
+	return tasks, cachedCount
 }
 
-func processImage(ctx context.Context, bucket *storage.BucketHandle, cache *ImageCache, img utils.Image, fl *fileLocker, progress *ProgressTracker) error {
-	filename := extractFilename(img.WebLocation)
+func processImage(ctx context.Context, store ObjectStore, cache *ImageCache, task imageTask, fl *fileLocker, report *ImageReport) error {
+	source := task.source()
+	key := cacheKey(source)
 
-	// Download image with retry
-	imageData, _, err := downloadImageWithRetry(img.WebLocation, maxRetries)
+	// When revalidating a cached image, ask the source to only send it if it changed
+	cached, isCached := lookupEntry(cache, source)
+	var validators *sourceValidators
+	if task.revalidate && isCached {
+		validators = &sourceValidators{ETag: cached.ETag, LastModified: cached.LastModified}
+	}
+
+	// Download (with retry) or read the original
+	blob, err := fetchImage(ctx, source, validators)
+	if errors.Is(err, errNotModified) {
+		report.Skip("not modified")
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("download failed: %w", err)
+		return fmt.Errorf("fetch failed: %w", err)
 	}
+	defer blob.Close()
+	report.AddDownload(blob.Size())
 
 	// Compute hash
-	hashReader := bytes.NewReader(imageData)
-	hash, err := ComputeHash(hashReader)
+	hash, err := ComputeHash(blob.Reader())
 	if err != nil {
 		return fmt.Errorf("hash computation failed: %w", err)
 	}
 
 	// Check if we already have this exact image (by hash)
-	if entry, ok := cache.Get(filename); ok && entry.Hash == hash {
-		progress.IncrementSkipped()
+	if isCached && cached.Hash == hash && !task.force {
+		// Remember the validators so the next revalidation can be conditional
+		if cached.ETag != blob.ETag || cached.LastModified != blob.LastModified {
+			updated := *cached
+			updated.ETag = blob.ETag
+			updated.LastModified = blob.LastModified
+			cache.Add(&updated)
+		}
+		report.Skip("unchanged")
 		return nil
 	}
 
+	// A cached image that reaches this point changed upstream
+	changed := isCached && cached.Hash != ""
+	if changed && !task.force {
+		slog.Info("changed upstream, reprocessing", "filename", utils.ImageFilename(source), "url", source)
+	}
+	if changed && cached.Filename != key {
+		// Name-layout entry superseded by a content-layout one
+		cache.Remove(cached.Filename)
+	}
+
+	// Identical content under another source already has its variants uploaded
+	if (objectLayout == layoutContent || isLocalImage(key)) && !task.force {
+		if existing, ok := cache.FindByHash(hash); ok && !isLegacyEntry(existing) {
+			entry := *existing
+			entry.Filename = key
+			entry.Timestamp = time.Now().Unix()
+			entry.ETag = blob.ETag
+			entry.LastModified = blob.LastModified
+			cache.Add(&entry)
+			report.Skip("duplicate of " + existing.Filename)
+			return nil
+		}
+	}
+
+	// Changed images keep their ID under the name layout, so their variants
+	// are overwritten rather than skipped as already uploaded
+	id := newObjectID(key, hash)
+	entry, err := processImageData(ctx, store, id, blob, changed || task.force, false, fl, report)
+	if err != nil {
+		return err
+	}
+	if entry.Archive, err = archiveOriginal(ctx, id, blob, changed || task.force, fl); err != nil {
+		return err
+	}
+
+	// Add to cache
+	entry.Filename = key
+	entry.Hash = hash
+	entry.Timestamp = time.Now().Unix()
+	entry.ETag = blob.ETag
+	entry.LastModified = blob.LastModified
+	cache.Add(entry)
+
+	if entry.GPS {
+		report.RecordGPS()
+	}
+	return nil
+}
+
+// processImageData decodes an original image and uploads all of its variants
+// named after id, replacing existing objects if overwrite is set. With
+// keepFullSize the full-size variants are never replaced, for when the blob
+// is one of them. The returned entry has dimensions and paths set; the caller
+// fills in filename, hash and timestamp.
+func processImageData(ctx context.Context, store ObjectStore, id string, blob *imageBlob, overwrite, keepFullSize bool, fl *fileLocker, report *ImageReport) (*CacheEntry, error) {
+	// Reserve memory for the decoded image before decoding it
+	imageConfig, _, err := image.DecodeConfig(blob.Reader())
+	if err != nil {
+		return nil, fmt.Errorf("decode failed: %w", err)
+	}
+	if err := checkImagePixels(imageConfig.Width, imageConfig.Height); err != nil {
+		return nil, err
+	}
+	reserved, err := imageMemory.Acquire(ctx, estimateImageMemory(imageConfig.Width, imageConfig.Height, blob))
+	if err != nil {
+		return nil, err
+	}
+	defer imageMemory.Release(reserved)
+
 	// Decode image
-	imageReader := bytes.NewReader(imageData)
-	img_decoded, format, err := image.Decode(imageReader)
+	img_decoded, format, err := image.Decode(blob.Reader())
 	if err != nil {
-		return fmt.Errorf("decode failed: %w", err)
+		return nil, fmt.Errorf("decode failed: %w", err)
 	}
 
-	// Load EXIF data (only for JPEG)
+	// Load EXIF data (only for JPEG), filtered by --exif-policy for the variants
+	var rootIfd *exif.Ifd
 	var exifBuilder *exif.IfdBuilder
+	orientation := orientationNormal
 	if format == "jpeg" {
-		mc, err := jis.NewJpegMediaParser().ParseBytes(imageData)
+		mc, err := jis.NewJpegMediaParser().Parse(blob.Reader(), int(blob.Size()))
 		if err == nil {
 			sl := mc.(*jis.SegmentList)
-			exifBuilder, _ = sl.ConstructExifBuilder()
+			if rootIfd, _, err = sl.Exif(); err == nil {
+				exifBuilder, err = buildExifBuilder(rootIfd, exifPolicy)
+				if err != nil {
+					return nil, fmt.Errorf("failed to apply EXIF policy: %w", err)
+				}
+				orientation = exifOrientation(rootIfd)
+			} else {
+				rootIfd = nil
+			}
 		}
 	}
 
-	// Get dimensions
+	// Rotate/flip the pixels upright before resizing, since the EXIF tag is
+	// ignored in some contexts, and reset the tag copied onto the variants
+	if orientation != orientationNormal {
+		img_decoded = applyOrientation(img_decoded, orientation)
+		if exifBuilder != nil {
+			if err := resetOrientation(exifBuilder); err != nil {
+				return nil, fmt.Errorf("failed to reset orientation: %w", err)
+			}
+		}
+	}
+
+	// Get dimensions (after rotation)
 	width := img_decoded.Bounds().Size().X
 	height := img_decoded.Bounds().Size().Y
 
 	// Process all width variants
-	gcsPaths, err := uploadImageVariants(ctx, bucket, img_decoded, filename, exifBuilder, width, height, fl)
+	variants, err := uploadImageVariants(ctx, store, img_decoded, id, exifBuilder, width, height, overwrite, keepFullSize, fl, report)
 	if err != nil {
-		return fmt.Errorf("upload failed: %w", err)
+		return nil, fmt.Errorf("upload failed: %w", err)
 	}
 
-	// Add to cache
 	entry := &CacheEntry{
-		Filename:  filename,
-		Hash:      hash,
-		Timestamp: time.Now().Unix(),
-		Width:     width,
-		Height:    height,
-		GCSPaths:  gcsPaths,
+		Width:    width,
+		Height:   height,
+		GCSPaths: make([]string, 0, len(variants)),
+		Color:    dominantColor(img_decoded),
 	}
-	cache.Add(entry)
-
-	progress.IncrementProcessed()
-	return nil
+	for _, variant := range variants {
+		entry.GCSPaths = append(entry.GCSPaths, variant.Path)
+		// Variants that already existed were not encoded, so their quality is unknown
+		if variant.Uploaded {
+			entry.setEncoding(variant.Path, VariantEncoding{Quality: variant.Quality, Bytes: variant.Bytes, Width: variant.Width, Height: variant.Height})
+		}
+	}
+	if rootIfd != nil {
+		applyExifMetadata(entry, rootIfd)
+	}
+	return entry, nil
 }
 
-func downloadImageWithRetry(url string, maxRetries int) ([]byte, string, error) {
-	var lastErr error
-
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		resp, err := httpClient.Get(url)
-		if err == nil && resp.StatusCode == http.StatusOK {
-			defer resp.Body.Close()
-			data, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, "", err
-			}
-			return data, resp.Header.Get("Content-Type"), nil
-		}
+// imageSource returns where an image's original can be fetched from:
+// its URL for web images, or its resolved path on disk for local images
+func imageSource(img utils.Image) string {
+	if img.WebLocation != "" {
+		return img.WebLocation
+	}
+	return resolveLocalImage(img)
+}
 
-		if resp != nil {
-			resp.Body.Close()
-			lastErr = fmt.Errorf("HTTP %d", resp.StatusCode)
-		} else {
-			lastErr = err
-		}
+// resolveLocalImage resolves a local markdown image path. Absolute paths are
+// served from the static directory; relative paths are tried next to the post
+// first and then under the static directory.
+func resolveLocalImage(img utils.Image) string {
+	// Drop an optional title: ![alt](path "title")
+	location, _, _ := strings.Cut(strings.TrimSpace(img.LocalLocation), " ")
 
-		if attempt < maxRetries {
-			backoff := baseBackoff * time.Duration(1<<uint(attempt))
-			time.Sleep(backoff)
-		}
+	staticPath := filepath.Join(utils.SiteDirectory, staticDirectory, filepath.FromSlash(location))
+	if strings.HasPrefix(location, "/") {
+		return staticPath
 	}
 
-	return nil, "", fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
+	postPath := filepath.Join(filepath.Dir(img.InFile), filepath.FromSlash(location))
+	if _, err := os.Stat(postPath); err == nil {
+		return postPath
+	}
+	return staticPath
 }
 
-func uploadImageVariants(ctx context.Context, bucket *storage.BucketHandle, img image.Image, filename string, exifBuilder *exif.IfdBuilder, origWidth, origHeight int, fl *fileLocker) ([]string, error) {
-	gcsPaths := make([]string, 0, len(imageWidths))
-	errChan := make(chan error, len(imageWidths))
+// uploadImageVariants uploads every rung of the ladder written for the image
+// (see rungSizes) and returns the variants in ladder order. Existing full-size
+// variants are kept even with overwrite if keepFullSize is set.
+func uploadImageVariants(ctx context.Context, store ObjectStore, img image.Image, id string, exifBuilder *exif.IfdBuilder, origWidth, origHeight int, overwrite, keepFullSize bool, fl *fileLocker, report *ImageReport) ([]VariantReport, error) {
+	// Never upscale or repeat a size; the variant already written serves it
+	sizes := rungSizes(origWidth, origHeight)
+	if len(sizes) < len(variantLadder) {
+		slog.Debug("rungs skipped, image is not larger or they would repeat a size", "id", id, "rungs", len(variantLadder)-len(sizes), "width", origWidth, "height", origHeight)
+	}
+
+	// One slot per rung/format pair so results keep a stable order
+	slots := make([][]VariantReport, len(sizes))
+	errChan := make(chan error, len(sizes))
 	wg := sync.WaitGroup{}
 
-	for i, width := range imageWidths {
+	for i, size := range sizes {
 		wg.Add(1)
-		go func(width, index int) {
+		go func(rung *Rung, newWidth, newHeight, index int) {
 			defer wg.Done()
 
-			// Calculate new dimensions
-			newWidth := width
-			if newWidth == 0 {
-				newWidth = origWidth
-			}
-			newHeight := calculateHeight(origWidth, origHeight, newWidth)
-
 			// Resize
 			resized := resize.Resize(uint(newWidth), uint(newHeight), img, resize.Lanczos3)
 
-			// Determine object path
-			suffix := ""
-			if width > 0 {
-				suffix = fmt.Sprintf("_%d", index)
-			}
-			// Strip extension from filename to avoid double extensions
-			baseFilename := strings.TrimSuffix(filename, ".jpeg")
-			baseFilename = strings.TrimSuffix(baseFilename, ".jpg")
-			baseFilename = strings.TrimSuffix(baseFilename, ".png")
-			objectPath := fmt.Sprintf("%s/%s%s.jpeg", gcsImagePath, baseFilename, suffix)
-
-			fl.Lock(objectPath)
-			defer fl.Unlock(objectPath)
-
-			// Check if exists
-			obj := bucket.Object(objectPath)
-			if _, err := obj.Attrs(ctx); err == nil {
-				// Already exists, skip
-				gcsPaths = append(gcsPaths, objectPath)
-				return
-			}
+			replace := overwrite && !(keepFullSize && rung.isOriginal())
+			for _, format := range rung.formats(variantFormats) {
+				objectPath := variantObjectPath(id, rung, format)
 
-			// Encode to JPEG
-			buf := &bytes.Buffer{}
-			if err := jpeg.Encode(buf, resized, nil); err != nil {
-				errChan <- fmt.Errorf("encode failed for %s: %w", objectPath, err)
-				return
-			}
-
-			// Apply EXIF if available
-			var finalBuf *bytes.Buffer
-			if exifBuilder != nil {
-				mc2, err := jis.NewJpegMediaParser().ParseBytes(buf.Bytes())
-				if err == nil {
-					sl2 := mc2.(*jis.SegmentList)
-					if err := sl2.SetExif(exifBuilder); err == nil {
-						finalBuf = &bytes.Buffer{}
-						if err := sl2.Write(finalBuf); err == nil {
-							buf = finalBuf
-						}
-					}
+				variant, err := uploadVariant(ctx, store, resized, objectPath, format, rung, exifBuilder, replace, fl, report)
+				if err != nil {
+					errChan <- err
+					return
 				}
-			}
-
-			// Upload
-			writer := obj.NewWriter(ctx)
-			writer.ContentType = "image/jpeg"
-			writer.CacheControl = "public, max-age=31536000, immutable"
 
-			if _, err := writer.Write(buf.Bytes()); err != nil {
-				writer.Close()
-				errChan <- fmt.Errorf("upload failed for %s: %w", objectPath, err)
-				return
-			}
-
-			if err := writer.Close(); err != nil {
-				errChan <- fmt.Errorf("close failed for %s: %w", objectPath, err)
-				return
+				slots[index] = append(slots[index], variant)
 			}
-
-			gcsPaths = append(gcsPaths, objectPath)
-		}(width, i)
+		}(size.rung, size.width, size.height, i)
 	}
 
 	wg.Wait()
@@ -428,25 +728,92 @@ func uploadImageVariants(ctx context.Context, bucket *storage.BucketHandle, img
 		return nil, err
 	}
 
-	return gcsPaths, nil
+	var variants []VariantReport
+	for _, slot := range slots {
+		variants = append(variants, slot...)
+	}
+	return variants, nil
 }
 
-func rebuildCacheFromGCS(ctx context.Context, bucket *storage.BucketHandle, cache *ImageCache) error {
-	fmt.Println("🔄 Rebuilding cache from GCS...")
+// uploadVariant encodes a resized image in the given format at the rung's
+// quality or size budget and uploads it, skipping objects that already exist
+// unless overwrite is set
+func uploadVariant(ctx context.Context, store ObjectStore, resized image.Image, objectPath string, format *ImageFormat, rung *Rung, exifBuilder *exif.IfdBuilder, overwrite bool, fl *fileLocker, report *ImageReport) (VariantReport, error) {
+	fl.Lock(objectPath)
+	defer fl.Unlock(objectPath)
+
+	variant := VariantReport{
+		Path:   objectPath,
+		Format: format.Name,
+		Width:  resized.Bounds().Dx(),
+		Height: resized.Bounds().Dy(),
+	}
 
-	query := &storage.Query{Prefix: gcsImagePath + "/"}
-	it := bucket.Objects(ctx, query)
+	// Check if exists
+	if attrs, err := store.Stat(ctx, objectPath); err == nil && !overwrite {
+		// Already exists, skip
+		variant.Bytes = attrs.Size
+		report.AddVariant(variant)
+		slog.Debug("variant exists", "variant", objectPath, "bytes", variant.Bytes)
+		return variant, nil
+	}
 
-	count := 0
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
+	// The size budget covers the EXIF as well, so it is applied on each try
+	data, quality, err := rung.encode(format, func(quality int) ([]byte, error) {
+		data, err := format.Encode(ctx, resized, quality)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
+		// Apply EXIF if available (JPEG only)
+		if exifBuilder != nil && format == jpegFormat {
+			mc2, err := jis.NewJpegMediaParser().ParseBytes(data)
+			if err == nil {
+				sl2 := mc2.(*jis.SegmentList)
+				if err := sl2.SetExif(exifBuilder); err == nil {
+					finalBuf := &bytes.Buffer{}
+					if err := sl2.Write(finalBuf); err == nil {
+						data = finalBuf.Bytes()
+					}
+				}
+			}
+		}
+		return data, nil
+	})
+	if err != nil {
+		return variant, fmt.Errorf("encode failed for %s: %w", objectPath, err)
+	}
+	if rung.MaxBytes > 0 && int64(len(data)) > int64(rung.MaxBytes) {
+		slog.Warn("variant over size budget at minimum quality", "variant", objectPath, "bytes", len(data), "max_bytes", int64(rung.MaxBytes), "quality", quality)
+	}
+
+	// Upload
+	opts := WriteOptions{
+		ContentType:  format.ContentType,
+		CacheControl: "public, max-age=31536000, immutable",
+	}
+	if err := store.Write(ctx, objectPath, bytes.NewReader(data), opts); err != nil {
+		return variant, fmt.Errorf("upload failed for %s: %w", objectPath, err)
+	}
+
+	variant.Bytes = int64(len(data))
+	variant.Quality = quality
+	variant.Uploaded = true
+	report.AddVariant(variant)
+	slog.Debug("variant uploaded", "variant", objectPath, "format", format.Name, "width", variant.Width, "height", variant.Height, "quality", quality, "bytes", variant.Bytes)
+	return variant, nil
+}
+
+func rebuildCacheFromGCS(ctx context.Context, store ObjectStore, cache *ImageCache) error {
+	slog.Info("rebuilding cache from object store")
+
+	objects, err := store.List(ctx, gcsImagePath+"/")
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, attrs := range objects {
 		// Extract filename
 		fullPath := attrs.Name
 		if !strings.HasPrefix(fullPath, gcsImagePath+"/") {
@@ -472,82 +839,62 @@ func rebuildCacheFromGCS(ctx context.Context, bucket *storage.BucketHandle, cach
 		}
 	}
 
-	fmt.Printf("Found %d unique images in GCS\n", count)
+	slog.Info("found images in object store", "count", count)
 
 	if err := cache.Save(); err != nil {
 		return err
 	}
 
-	fmt.Println("✓ Cache rebuilt successfully")
+	slog.Info("cache rebuilt")
 	return nil
 }
 
-func verifyCacheIntegrity(ctx context.Context, bucket *storage.BucketHandle, cache *ImageCache) {
-	fmt.Println("🔍 Verifying cache integrity...")
-	// TODO: Implement verification logic
-	fmt.Println("✓ Verification complete")
-}
-
-func handleMaintenance(ctx context.Context, bucket *storage.BucketHandle, cache *ImageCache, config *Config) {
+func handleMaintenance(ctx context.Context, store ObjectStore, cache *ImageCache, config *Config) error {
 	switch config.MaintenanceOp {
 	case "stats":
 		printCacheStats(cache)
 	case "export":
-		exportCache(cache)
+		return exportCache(cache, config)
 	case "repair":
-		repairCache(cache)
+		return repairCache(ctx, store, cache, config)
+	case "gc":
+		return collectGarbage(ctx, store, cache, config)
+	case "hugo-data":
+		return updateHugoData(cache, config)
 	default:
-		fmt.Printf("Unknown maintenance operation: %s\n", config.MaintenanceOp)
-	}
-}
-
-func printCacheStats(cache *ImageCache) {
-	stats := cache.Stats()
-	fmt.Println("\n=== Cache Statistics ===")
-	for key, value := range stats {
-		fmt.Printf("%s: %v\n", key, value)
+		slog.Warn("unknown maintenance operation", "op", config.MaintenanceOp)
 	}
+	return nil
 }
 
-func exportCache(cache *ImageCache) {
-	// TODO: Implement cache export
-	fmt.Println("Export functionality not yet implemented")
-}
-
-func repairCache(cache *ImageCache) {
-	// TODO: Implement cache repair
-	fmt.Println("Repair functionality not yet implemented")
-}
-
-func extractFilename(url string) string {
-	parts := strings.Split(url, "/")
-	filename := parts[len(parts)-1]
-
-	// Remove query parameters if present
-	if idx := strings.Index(filename, "?"); idx != -1 {
-		filename = filename[:idx]
+// updateHugoData rewrites the Hugo data files that are not disabled
+func updateHugoData(cache *ImageCache, config *Config) error {
+	if config.HugoData != "" {
+		if err := writeHugoData(cache, config.HugoData); err != nil {
+			return err
+		}
 	}
-
-	// Ensure .jpeg extension for GitHub asset URLs
-	if !strings.HasSuffix(filename, ".jpeg") && !strings.HasSuffix(filename, ".jpg") && !strings.HasSuffix(filename, ".png") {
-		filename = filename + ".jpeg"
+	if config.HugoLocations != "" {
+		if err := writeHugoLocations(cache, config.HugoLocations); err != nil {
+			return err
+		}
 	}
-
-	return filename
+	return nil
 }
 
-func extractBaseFilename(filename string) string {
-	for _, suffix := range []string{"_0.jpeg", "_1.jpeg", "_2.jpeg", "_3.jpeg"} {
-		if strings.HasSuffix(filename, suffix) {
-			return strings.TrimSuffix(filename, suffix) + ".jpeg"
-		}
+func printCacheStats(cache *ImageCache) {
+	stats := cache.Stats()
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
 	}
-	return filename
-}
+	sort.Strings(keys)
 
-func calculateHeight(oldX, oldY, newX int) int {
-	aspectRatio := float64(oldX) / float64(oldY)
-	return int(float64(newX) / aspectRatio)
+	attrs := make([]any, 0, len(keys)*2)
+	for _, key := range keys {
+		attrs = append(attrs, key, stats[key])
+	}
+	slog.Info("cache statistics", attrs...)
 }
 
 type fileLocker struct {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,10 +16,13 @@ type ProgressTracker struct {
 	processed int
 	skipped   int
 	failed    int
+	cacheHits int
 	startTime time.Time
 
 	currentImage string
 	errors       []ProcessingError
+	gpsImages    []string
+	images       []*ImageReport
 }
 
 // ProcessingError represents a failed image processing attempt
@@ -25,6 +30,7 @@ type ProcessingError struct {
 	Filename string
 	URL      string
 	Error    error
+	Class    ErrorClass
 	Time     time.Time
 }
 
@@ -51,33 +57,77 @@ func (p *ProgressTracker) IncrementProcessed() {
 	p.processed++
 }
 
-// IncrementSkipped increments the skipped counter
-func (p *ProgressTracker) IncrementSkipped() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.skipped++
-}
-
-// IncrementFailed increments the failed counter
-func (p *ProgressTracker) IncrementFailed() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.failed++
-}
-
 // AddError adds an error to the tracker
 func (p *ProgressTracker) AddError(filename, url string, err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.addError(filename, url, err)
+}
+
+func (p *ProgressTracker) addError(filename, url string, err error) {
 	p.failed++
 	p.errors = append(p.errors, ProcessingError{
 		Filename: filename,
 		URL:      url,
 		Error:    err,
+		Class:    classifyError(err),
 		Time:     time.Now(),
 	})
 }
 
+// StartImage starts timing an image and returns its report, to be passed to
+// FinishImage once it is done
+func (p *ProgressTracker) StartImage(filename, source string) *ImageReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	report := &ImageReport{
+		start:    time.Now(),
+		Filename: filename,
+		Source:   source,
+	}
+	p.images = append(p.images, report)
+	return report
+}
+
+// FinishImage counts an image as failed if err is set, skipped if its report
+// was marked so and processed otherwise, and logs the outcome
+func (p *ProgressTracker) FinishImage(report *ImageReport, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	duration := time.Since(report.start)
+	report.DurationMs = duration.Milliseconds()
+	attrs := []any{"filename", report.Filename, "url", report.Source, "duration", duration.Round(time.Millisecond)}
+	switch {
+	case err != nil:
+		report.Status = statusFailed
+		report.Error = err.Error()
+		report.ErrorClass = classifyError(err)
+		p.addError(report.Filename, report.Source, err)
+		slog.Error("image failed", append(attrs, "class", report.ErrorClass, "error", err)...)
+	case report.Status == statusSkipped:
+		p.skipped++
+		if isCacheHit(report.Reason) {
+			p.cacheHits++
+		}
+		slog.Debug("image skipped", append(attrs, "reason", report.Reason)...)
+	default:
+		report.Status = statusProcessed
+		p.processed++
+		slog.Info("image processed", append(attrs,
+			"bytes_downloaded", report.BytesDownloaded,
+			"bytes_uploaded", report.BytesUploaded,
+			"variants", len(report.Variants),
+		)...)
+	}
+
+	if report.gps {
+		p.gpsImages = append(p.gpsImages, report.Filename)
+	}
+}
+
 // GetProgress returns current progress information
 func (p *ProgressTracker) GetProgress() (processed, skipped, failed, total int) {
 	p.mu.Lock()
@@ -85,8 +135,13 @@ func (p *ProgressTracker) GetProgress() (processed, skipped, failed, total int)
 	return p.processed, p.skipped, p.failed, p.total
 }
 
-// PrintProgress prints a progress update
+// PrintProgress redraws the progress line. It is only shown when stdout is
+// a terminal; otherwise the per-image log records show progress.
 func (p *ProgressTracker) PrintProgress() {
+	if !stdout.Terminal() {
+		return
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -105,7 +160,7 @@ func (p *ProgressTracker) PrintProgress() {
 		eta = "calculating..."
 	}
 
-	fmt.Printf("\r[%3.0f%%] %d/%d images | Processed: %d | Skipped: %d | Failed: %d | Elapsed: %s | ETA: %s",
+	stdout.SetStatus(fmt.Sprintf("[%3.0f%%] %d/%d images | Processed: %d | Skipped: %d | Failed: %d | Elapsed: %s | ETA: %s",
 		percentage,
 		completed,
 		p.total,
@@ -114,37 +169,48 @@ func (p *ProgressTracker) PrintProgress() {
 		p.failed,
 		formatDuration(elapsed),
 		eta,
-	)
+	))
 }
 
-// PrintSummary prints a final summary
+// PrintSummary logs the final counts, errors, tripped circuit breakers and
+// images that carried GPS data
 func (p *ProgressTracker) PrintSummary() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	fmt.Println("\n\n=== Processing Summary ===")
-	fmt.Printf("Total images:     %d\n", p.total)
-	fmt.Printf("Processed:        %d\n", p.processed)
-	fmt.Printf("Skipped (cached): %d\n", p.skipped)
-	fmt.Printf("Failed:           %d\n", p.failed)
-	fmt.Printf("Total time:       %s\n", formatDuration(time.Since(p.startTime)))
-
+	elapsed := time.Since(p.startTime)
+	attrs := []any{
+		"total", p.total,
+		"processed", p.processed,
+		"skipped", p.skipped,
+		"failed", p.failed,
+		"duration", formatDuration(elapsed),
+	}
 	if p.processed > 0 {
-		avgTime := time.Since(p.startTime) / time.Duration(p.processed)
-		fmt.Printf("Avg time/image:   %s\n", formatDuration(avgTime))
+		attrs = append(attrs, "avg_per_image", formatDuration(elapsed/time.Duration(p.processed)))
 	}
+	// Calculate cache hit rate
+	if p.total > 0 {
+		hitRate := float64(p.cacheHits) / float64(p.total) * 100
+		attrs = append(attrs, "cache_hit_rate", fmt.Sprintf("%.1f%%", hitRate))
+	}
+	slog.Info("processing summary", attrs...)
 
-	if len(p.errors) > 0 {
-		fmt.Println("\n=== Errors ===")
-		for i, err := range p.errors {
-			fmt.Printf("%d. %s (%s): %v\n", i+1, err.Filename, err.URL, err.Error)
-		}
+	for _, err := range p.errors {
+		slog.Error("failed image", "filename", err.Filename, "url", err.URL, "class", err.Class, "error", err.Error)
 	}
 
-	// Calculate cache hit rate
-	if p.total > 0 {
-		hitRate := float64(p.skipped) / float64(p.total) * 100
-		fmt.Printf("\nCache hit rate: %.1f%%\n", hitRate)
+	for _, host := range hostBreaker.Tripped() {
+		slog.Warn("circuit breaker open", "host", host.Host, "rejected", host.Rejected, "last_error", host.LastErr)
+	}
+
+	sort.Strings(p.gpsImages)
+	for _, filename := range p.gpsImages {
+		if exifPolicy == exifPolicyKeep {
+			slog.Warn("GPS position published with variants", "filename", filename, "exif_policy", exifPolicy)
+		} else {
+			slog.Info("image with GPS data", "filename", filename, "exif_policy", exifPolicy)
+		}
 	}
 }
 
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/devhou-se/www-jp/go/utils"
+)
+
+// isLegacyEntry reports whether an entry is missing the metadata added in v2.0,
+// as created by parseLegacyEntry and rebuildCacheFromGCS. The hash is not
+// required: entries repaired from the stored full-size variant never get one,
+// and would otherwise be repaired again on every run.
+func isLegacyEntry(entry *CacheEntry) bool {
+	return entry.Width == 0 || entry.Height == 0 || len(entry.GCSPaths) == 0
+}
+
+// repairCache backfills legacy entries and re-uploads variants missing from the store
+func repairCache(ctx context.Context, store ObjectStore, cache *ImageCache, config *Config) error {
+	slog.Info("repairing cache")
+
+	// Map cache filenames back to the URLs or local paths they came from
+	images, err := utils.Images()
+	if err != nil {
+		return fmt.Errorf("failed to get images: %w", err)
+	}
+	sources := make(map[string]string, len(images))
+	for _, img := range images {
+		source := imageSource(img)
+		sources[utils.ImageFilename(source)] = source
+		sources[source] = source
+	}
+
+	objects, err := store.List(ctx, gcsImagePath+"/")
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, attrs := range objects {
+		stored[attrs.Name] = true
+	}
+
+	var toRepair []*CacheEntry
+	for _, entry := range cache.Entries() {
+		missing := 0
+		for _, objectPath := range variantObjectPaths(entry.ObjectID(), entry.Width, entry.Height, variantFormats) {
+			if !stored[objectPath] {
+				missing++
+			}
+		}
+
+		// Originals can only be archived from their source
+		unarchived := archivePrefix != "" && entry.Archive == "" && sources[entry.Filename] != ""
+
+		if !isLegacyEntry(entry) && missing == 0 && !unarchived {
+			continue
+		}
+
+		level := slog.LevelDebug
+		if config.DryRun {
+			level = slog.LevelInfo
+		}
+		slog.Log(ctx, level, "needs repair", "filename", entry.Filename, "legacy", isLegacyEntry(entry), "missing_variants", missing, "unarchived", unarchived)
+		toRepair = append(toRepair, entry)
+	}
+
+	slog.Info("checked cache entries", "entries", cache.Size(), "to_repair", len(toRepair))
+
+	if len(toRepair) == 0 || config.DryRun {
+		return nil
+	}
+
+	progress := NewProgressTracker(len(toRepair))
+	sem := semaphore.NewWeighted(int64(config.Parallelism))
+	wg := sync.WaitGroup{}
+	fl := &fileLocker{fl: make(map[string]*sync.Mutex)}
+
+	for _, entry := range toRepair {
+		wg.Add(1)
+		entry := entry // Capture loop variable
+
+		go func() {
+			defer wg.Done()
+
+			if err := sem.Acquire(ctx, 1); err != nil {
+				progress.AddError(entry.Filename, sources[entry.Filename], err)
+				return
+			}
+			defer sem.Release(1)
+
+			progress.SetCurrent(entry.Filename)
+
+			if err := repairEntry(ctx, store, cache, entry, sources[entry.Filename], false, fl, nil); err != nil {
+				progress.AddError(entry.Filename, sources[entry.Filename], err)
+				return
+			}
+			progress.IncrementProcessed()
+		}()
+	}
+
+	wg.Wait()
+
+	progress.PrintSummary()
+
+	if err := cache.Save(); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	slog.Info("cache saved", "entries", cache.Size())
+
+	if err := updateHugoData(cache, config); err != nil {
+		return fmt.Errorf("failed to write hugo data: %w", err)
+	}
+
+	if progress.HasErrors() {
+		return fmt.Errorf("repair completed with %d errors", len(progress.GetErrors()))
+	}
+	return nil
+}
+
+// repairEntry fetches the original for an entry, re-uploads any missing variants
+// and fills in hash, dimensions and paths.
+//
+// The original is fetched from the markdown source when it is still referenced,
+// or else read from the archive (--archive-bucket) if it was archived and the
+// archive is configured. Failing both, the full-size variant is read back from
+// the store; that copy has been re-encoded and possibly scaled down, so its hash
+// would not match the source and the hash is left empty. The full-size variants
+// are then never overwritten, as the copy would only be re-encoded from itself.
+//
+// An original whose hash differs from the recorded one changed since its
+// variants were made, so they are regenerated rather than kept.
+func repairEntry(ctx context.Context, store ObjectStore, cache *ImageCache, entry *CacheEntry, source string, overwrite bool, fl *fileLocker, report *ImageReport) error {
+	var blob *imageBlob
+	hash := entry.Hash
+	original := true
+
+	if source != "" {
+		var err error
+		blob, err = fetchImage(ctx, source, nil)
+		if err != nil {
+			return fmt.Errorf("fetch failed: %w", err)
+		}
+		defer blob.Close()
+	} else {
+		storedPath, storedIn := entry.Archive, archiveStore
+		if storedPath == "" || archiveStore == nil {
+			storedPath, storedIn = variantObjectPath(entry.ObjectID(), originalRung(), jpegFormat), store
+			original = false
+		}
+		reader, err := storedIn.Read(ctx, storedPath)
+		if err != nil {
+			return fmt.Errorf("no source and failed to read %s: %w", storedPath, err)
+		}
+		blob, err = readBlob(reader, -1)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", storedPath, err)
+		}
+		defer blob.Close()
+	}
+	report.AddDownload(blob.Size())
+
+	if original {
+		var err error
+		hash, err = ComputeHash(blob.Reader())
+		if err != nil {
+			return fmt.Errorf("hash computation failed: %w", err)
+		}
+		if entry.Hash != "" && hash != entry.Hash {
+			slog.Info("source changed since processed, regenerating variants", "filename", entry.Filename)
+			overwrite = true
+		}
+	}
+
+	// Rebuilding the full-size variant from itself would only re-encode it
+	repaired, err := processImageData(ctx, store, entry.ObjectID(), blob, overwrite, !original, fl, report)
+	if err != nil {
+		return err
+	}
+
+	repaired.Filename = entry.Filename
+	repaired.Hash = hash
+	repaired.Timestamp = entry.Timestamp
+	if repaired.Timestamp == 0 {
+		repaired.Timestamp = time.Now().Unix()
+	}
+	repaired.Archive = entry.Archive
+	// Variants that were kept rather than re-encoded keep their recorded encoding
+	for _, objectPath := range repaired.GCSPaths {
+		if _, ok := repaired.Encoding(objectPath); ok {
+			continue
+		}
+		if encoding, ok := entry.Encoding(objectPath); ok {
+			repaired.setEncoding(objectPath, encoding)
+		}
+	}
+	if original {
+		// Backfill the archive for images processed before it was enabled
+		archived, err := archiveOriginal(ctx, entry.ObjectID(), blob, overwrite, fl)
+		if err != nil {
+			return err
+		}
+		if archived != "" {
+			repaired.Archive = archived
+		}
+	}
+
+	switch {
+	case source != "":
+		repaired.ETag = blob.ETag
+		repaired.LastModified = blob.LastModified
+	case original:
+		// The archive holds what the source last sent
+		repaired.ETag = entry.ETag
+		repaired.LastModified = entry.LastModified
+	default:
+		// The stored copy had its EXIF filtered, so keep what the original had
+		repaired.GPS = entry.GPS
+		repaired.Location = entry.Location
+		if repaired.Taken == "" {
+			repaired.Taken = entry.Taken
+		}
+		if repaired.CameraMake == "" && repaired.CameraModel == "" {
+			repaired.CameraMake = entry.CameraMake
+			repaired.CameraModel = entry.CameraModel
+		}
+	}
+	cache.Add(repaired)
+
+	return nil
+}
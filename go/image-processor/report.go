@@ -0,0 +1,207 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Image outcomes in the run report
+const (
+	statusProcessed = "processed"
+	statusSkipped   = "skipped"
+	statusFailed    = "failed"
+)
+
+// RunReport is the machine-readable result of a processing run, written by --report
+type RunReport struct {
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	DurationMs   int64     `json:"duration_ms"`
+	DryRun       bool      `json:"dry_run"`
+	Interrupted  bool      `json:"interrupted"`
+	ExifPolicy   string    `json:"exif_policy"`
+	ObjectLayout string    `json:"object_layout"`
+
+	// Found is every image linked from markdown; Cached were not queued at all
+	Found     int `json:"found"`
+	Cached    int `json:"cached"`
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+	Skipped   int `json:"skipped"`
+	Failed    int `json:"failed"`
+
+	// CacheHitRate is the share of found images that needed no processing
+	CacheHitRate float64 `json:"cache_hit_rate"`
+
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+
+	Images       []*ImageReport `json:"images"`
+	Errors       []ErrorReport  `json:"errors"`
+	TrippedHosts []HostReport   `json:"tripped_hosts"`
+	GPSImages    []string       `json:"gps_images"`
+}
+
+// ImageReport is the outcome of one queued image
+type ImageReport struct {
+	mu    sync.Mutex
+	start time.Time
+
+	Filename        string          `json:"filename"`
+	Source          string          `json:"source,omitempty"`
+	Status          string          `json:"status"`
+	Reason          string          `json:"reason,omitempty"`
+	DurationMs      int64           `json:"duration_ms"`
+	BytesDownloaded int64           `json:"bytes_downloaded"`
+	BytesUploaded   int64           `json:"bytes_uploaded"`
+	Variants        []VariantReport `json:"variants,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	ErrorClass      ErrorClass      `json:"error_class,omitempty"`
+
+	gps bool
+}
+
+// VariantReport is one variant of an image. Variants that already existed
+// are not re-encoded and have Uploaded false with their stored size and no
+// quality.
+type VariantReport struct {
+	Path     string `json:"path"`
+	Format   string `json:"format"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Quality  int    `json:"quality,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	Uploaded bool   `json:"uploaded"`
+}
+
+// ErrorReport is a failed image
+type ErrorReport struct {
+	Filename string     `json:"filename"`
+	URL      string     `json:"url,omitempty"`
+	Error    string     `json:"error"`
+	Class    ErrorClass `json:"class"`
+	Time     time.Time  `json:"time"`
+}
+
+// HostReport is a host whose circuit breaker tripped
+type HostReport struct {
+	Host      string `json:"host"`
+	Rejected  int    `json:"rejected"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// isCacheHit reports whether a skip reason means the stored variants were
+// already current. Other skips, like dry runs, did no work but hit nothing.
+func isCacheHit(reason string) bool {
+	return reason == "unchanged" || reason == "not modified" || strings.HasPrefix(reason, "duplicate of ")
+}
+
+// Skip marks the image as needing no work, with the reason why
+func (r *ImageReport) Skip(reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Status = statusSkipped
+	r.Reason = reason
+}
+
+// AddDownload records the bytes fetched for the original
+func (r *ImageReport) AddDownload(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.BytesDownloaded += n
+}
+
+// AddVariant records a variant, uploaded or already present
+func (r *ImageReport) AddVariant(variant VariantReport) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Variants = append(r.Variants, variant)
+	if variant.Uploaded {
+		r.BytesUploaded += variant.Bytes
+	}
+}
+
+// RecordGPS notes that the original carried a GPS position
+func (r *ImageReport) RecordGPS() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gps = true
+}
+
+// Report returns the run result so far. found and cached are the distinct
+// images linked from markdown and those not queued because they were cached.
+func (p *ProgressTracker) Report(found, cached int) *RunReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	report := &RunReport{
+		StartedAt:    p.startTime,
+		FinishedAt:   now,
+		DurationMs:   now.Sub(p.startTime).Milliseconds(),
+		ExifPolicy:   exifPolicy,
+		ObjectLayout: objectLayout,
+		Found:        found,
+		Cached:       cached,
+		Total:        p.total,
+		Processed:    p.processed,
+		Skipped:      p.skipped,
+		Failed:       p.failed,
+		Images:       make([]*ImageReport, 0, len(p.images)),
+		Errors:       make([]ErrorReport, 0, len(p.errors)),
+		TrippedHosts: make([]HostReport, 0),
+		GPSImages:    append([]string{}, p.gpsImages...),
+	}
+	if found > 0 {
+		report.CacheHitRate = float64(cached+p.cacheHits) / float64(found)
+	}
+
+	for _, image := range p.images {
+		image.mu.Lock()
+		report.BytesDownloaded += image.BytesDownloaded
+		report.BytesUploaded += image.BytesUploaded
+		sort.Slice(image.Variants, func(i, j int) bool {
+			return image.Variants[i].Path < image.Variants[j].Path
+		})
+		image.mu.Unlock()
+		report.Images = append(report.Images, image)
+	}
+	sort.Slice(report.Images, func(i, j int) bool {
+		return report.Images[i].Filename < report.Images[j].Filename
+	})
+
+	for _, err := range p.errors {
+		report.Errors = append(report.Errors, ErrorReport{
+			Filename: err.Filename,
+			URL:      err.URL,
+			Error:    err.Error.Error(),
+			Class:    err.Class,
+			Time:     err.Time,
+		})
+	}
+
+	for _, host := range hostBreaker.Tripped() {
+		hostReport := HostReport{Host: host.Host, Rejected: host.Rejected}
+		if host.LastErr != nil {
+			hostReport.LastError = host.LastErr.Error()
+		}
+		report.TrippedHosts = append(report.TrippedHosts, hostReport)
+	}
+	sort.Strings(report.GPSImages)
+
+	return report
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/devhou-se/www-jp/go/utils"
+)
+
+// reprocessPatterns is the --reprocess flag: image filenames or IDs, source
+// URLs or paths, post paths or globs of any of these, comma-separated or
+// given by repeating the flag
+type reprocessPatterns []string
+
+func (p *reprocessPatterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *reprocessPatterns) Set(value string) error {
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "./")
+		if pattern == "" {
+			continue
+		}
+		*p = append(*p, filepath.ToSlash(pattern))
+	}
+	return nil
+}
+
+// reprocessMatcher selects the images --reprocess applies to and remembers
+// which patterns matched anything
+type reprocessMatcher struct {
+	patterns []string
+	matched  map[string]bool
+}
+
+func newReprocessMatcher(patterns []string) *reprocessMatcher {
+	return &reprocessMatcher{
+		patterns: patterns,
+		matched:  make(map[string]bool),
+	}
+}
+
+// Match reports whether any pattern equals or globs one of the candidates
+func (m *reprocessMatcher) Match(candidates ...string) bool {
+	found := false
+	for _, pattern := range m.patterns {
+		for _, candidate := range candidates {
+			if candidate == "" {
+				continue
+			}
+			if ok, _ := path.Match(pattern, candidate); ok || pattern == candidate {
+				m.matched[pattern] = true
+				found = true
+				break
+			}
+		}
+	}
+	return found
+}
+
+// MatchImage reports whether a markdown image is selected, by its source,
+// filename, object ID or the post it appears in
+func (m *reprocessMatcher) MatchImage(img utils.Image, cache *ImageCache) bool {
+	if len(m.patterns) == 0 {
+		return false
+	}
+
+	source := imageSource(img)
+	filename := utils.ImageFilename(source)
+	candidates := []string{source, filepath.ToSlash(source), filename, utils.ImageID(filename), filepath.ToSlash(img.InFile)}
+	if entry, ok := lookupEntry(cache, source); ok {
+		candidates = append(candidates, entry.ObjectID())
+	}
+	return m.Match(candidates...)
+}
+
+// Unmatched returns the patterns that selected no image
+func (m *reprocessMatcher) Unmatched() []string {
+	var unmatched []string
+	for _, pattern := range m.patterns {
+		if !m.matched[pattern] {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	return unmatched
+}
+
+// lazyReprocessTasks returns tasks for selected images that posts only embed
+// with the lazyimage shortcode, so have no markdown link to fetch from. They
+// are regenerated like a repair, from their source if the cache key is one
+// (content layout) or else from the stored original. IDs in skip are already
+// being reprocessed from a link.
+func lazyReprocessTasks(cache *ImageCache, m *reprocessMatcher, skip map[string]bool) ([]imageTask, error) {
+	if len(m.patterns) == 0 {
+		return nil, nil
+	}
+
+	lazyImages, err := utils.LazyImages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find lazyimage shortcodes: %w", err)
+	}
+
+	entriesByID := make(map[string]*CacheEntry)
+	for _, entry := range cache.Entries() {
+		entriesByID[entry.ObjectID()] = entry
+	}
+
+	var tasks []imageTask
+	for _, img := range lazyImages {
+		entry, ok := entriesByID[img.ID]
+		if !ok || skip[img.ID] {
+			continue
+		}
+		if !m.Match(img.ID, filepath.ToSlash(img.InFile), entry.Filename) {
+			continue
+		}
+		skip[img.ID] = true
+		tasks = append(tasks, imageTask{entry: entry, force: true})
+	}
+	return tasks, nil
+}
+
+// entrySource returns the source an entry can be fetched from, or "" if its
+// key is a bare filename (name layout)
+func entrySource(entry *CacheEntry) string {
+	if strings.Contains(filepath.ToSlash(entry.Filename), "/") {
+		return entry.Filename
+	}
+	return ""
+}
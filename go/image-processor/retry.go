@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps how long a single Retry-After or rate limit reset is waited for
+const maxRetryAfter = 2 * time.Minute
+
+// ErrorClass says whether a failed image may succeed if tried again
+type ErrorClass string
+
+const (
+	// ErrorRetryable failures are transient: timeouts, 5xx, rate limits
+	ErrorRetryable ErrorClass = "retryable"
+	// ErrorPermanent failures will fail again: 404s, oversized or undecodable images
+	ErrorPermanent ErrorClass = "permanent"
+	// ErrorCanceled means the run was interrupted before the image finished
+	ErrorCanceled ErrorClass = "canceled"
+)
+
+// classifiedError attaches an ErrorClass to an error
+type classifiedError struct {
+	class ErrorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func retryable(err error) error {
+	return &classifiedError{class: ErrorRetryable, err: err}
+}
+
+func permanent(err error) error {
+	return &classifiedError{class: ErrorPermanent, err: err}
+}
+
+// classifyError returns the class of an error anywhere in its chain.
+// Unclassified network errors are retryable; anything else is permanent.
+func classifyError(err error) ErrorClass {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCanceled
+	}
+
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorRetryable
+	}
+	return ErrorPermanent
+}
+
+// httpStatusError classifies a non-200 response
+func httpStatusError(resp *http.Response) error {
+	err := fmt.Errorf("HTTP %d", resp.StatusCode)
+
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooEarly,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return retryable(err)
+	case resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0":
+		// GitHub reports exhausted rate limits as 403
+		return retryable(fmt.Errorf("%w (rate limited)", err))
+	default:
+		return permanent(err)
+	}
+}
+
+// retryAfter returns how long the server asked us to wait before retrying,
+// from Retry-After on 429/503 or GitHub's rate limit reset, or 0 if it didn't say
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	var wait time.Duration
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		value := resp.Header.Get("Retry-After")
+		if seconds, err := strconv.Atoi(value); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		} else if at, err := http.ParseTime(value); err == nil {
+			wait = at.Sub(now)
+		}
+	case http.StatusForbidden:
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			wait = time.Unix(reset, 0).Sub(now)
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return min(wait, maxRetryAfter)
+}
+
+// backoffDelay returns the exponential backoff before retry number attempt
+// (starting at 0), with jitter so parallel workers don't retry in lockstep
+func backoffDelay(attempt int) time.Duration {
+	backoff := baseBackoff * time.Duration(1<<uint(attempt))
+	// Equal jitter: between half and all of the backoff
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
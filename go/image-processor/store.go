@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ErrObjectNotExist is returned by an ObjectStore when the named object is missing
+var ErrObjectNotExist = errors.New("object does not exist")
+
+// ObjectAttrs describes a stored object
+type ObjectAttrs struct {
+	Name         string
+	Size         int64
+	ContentType  string
+	CacheControl string
+	Created      time.Time
+}
+
+// WriteOptions holds the metadata attached to an object on write
+type WriteOptions struct {
+	ContentType  string
+	CacheControl string
+}
+
+// ObjectStore is the storage backend that image variants are written to
+type ObjectStore interface {
+	// Stat returns the attributes of an object, or ErrObjectNotExist
+	Stat(ctx context.Context, name string) (*ObjectAttrs, error)
+	// Write creates or replaces an object with the contents of r
+	Write(ctx context.Context, name string, r io.Reader, opts WriteOptions) error
+	// Read opens an object for reading, or returns ErrObjectNotExist
+	Read(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns all objects whose name starts with prefix, sorted by name
+	List(ctx context.Context, prefix string) ([]ObjectAttrs, error)
+	// Delete removes an object, or returns ErrObjectNotExist
+	Delete(ctx context.Context, name string) error
+}
+
+// openStore creates the object store selected by config.Store.
+// The returned function releases any resources held by the store.
+func openStore(ctx context.Context, config *Config) (ObjectStore, func() error, error) {
+	switch config.Store {
+	case "gcs":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		return &gcsStore{bucket: client.Bucket(gcsBucketName)}, client.Close, nil
+	case "local":
+		if config.StoreDir == "" {
+			return nil, nil, fmt.Errorf("--store-dir is required for the local store")
+		}
+		return &localStore{root: config.StoreDir}, func() error { return nil }, nil
+	case "memory":
+		return newMemoryStore(), func() error { return nil }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store %q (expected gcs, local or memory)", config.Store)
+	}
+}
+
+// openArchiveStore opens the store for archived originals from --archive-bucket,
+// or returns nil if archiving is disabled. The image bucket is publicly
+// readable, so on GCS the archive must be a bucket of its own; the local store
+// takes a directory other than --store-dir, and the memory store gets a
+// separate store.
+func openArchiveStore(ctx context.Context, config *Config) (ObjectStore, func() error, error) {
+	noop := func() error { return nil }
+	if archivePrefix == "" {
+		return nil, noop, nil
+	}
+
+	bucket := config.ArchiveBucket
+	switch config.Store {
+	case "gcs":
+		if bucket == "" {
+			return nil, nil, fmt.Errorf("--archive-bucket is required with --archive-prefix")
+		}
+		if bucket == gcsBucketName {
+			return nil, nil, fmt.Errorf("refusing to archive originals into the public bucket %s", gcsBucketName)
+		}
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		return &gcsStore{bucket: client.Bucket(bucket)}, client.Close, nil
+	case "local":
+		if bucket == "" {
+			return nil, nil, fmt.Errorf("--archive-bucket (a directory) is required with --archive-prefix")
+		}
+		if filepath.Clean(bucket) == filepath.Clean(config.StoreDir) {
+			return nil, nil, fmt.Errorf("refusing to archive originals into the image store %s", config.StoreDir)
+		}
+		return &localStore{root: bucket}, noop, nil
+	default:
+		return newMemoryStore(), noop, nil
+	}
+}
+
+// gcsStore is an ObjectStore backed by a Google Cloud Storage bucket
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+func (s *gcsStore) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gcsObjectAttrs(attrs), nil
+}
+
+func (s *gcsStore) Write(ctx context.Context, name string, r io.Reader, opts WriteOptions) error {
+	writer := s.bucket.Object(name).NewWriter(ctx)
+	writer.ContentType = opts.ContentType
+	writer.CacheControl = opts.CacheControl
+
+	if _, err := io.Copy(writer, r); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *gcsStore) Read(ctx context.Context, name string) (io.ReadCloser, error) {
+	reader, err := s.bucket.Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrObjectNotExist
+	}
+	return reader, err
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]ObjectAttrs, error) {
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+	var objects []ObjectAttrs
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, *gcsObjectAttrs(attrs))
+	}
+	return objects, nil
+}
+
+func (s *gcsStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrObjectNotExist
+	}
+	return err
+}
+
+func gcsObjectAttrs(attrs *storage.ObjectAttrs) *ObjectAttrs {
+	return &ObjectAttrs{
+		Name:         attrs.Name,
+		Size:         attrs.Size,
+		ContentType:  attrs.ContentType,
+		CacheControl: attrs.CacheControl,
+		Created:      attrs.Created,
+	}
+}
+
+// localStore is an ObjectStore backed by a directory on the local filesystem.
+// Object names map directly to paths under root. Content types are derived
+// from the file extension and cache-control headers are not persisted.
+type localStore struct {
+	root string
+}
+
+func (s *localStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *localStore) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	info, err := os.Stat(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return localObjectAttrs(name, info), nil
+}
+
+func (s *localStore) Write(ctx context.Context, name string, r io.Reader, opts WriteOptions) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStore) Read(ctx context.Context, name string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotExist
+	}
+	return file, err
+}
+
+func (s *localStore) List(ctx context.Context, prefix string) ([]ObjectAttrs, error) {
+	var objects []ObjectAttrs
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == s.root {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *localObjectAttrs(name, info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *localStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrObjectNotExist
+	}
+	return err
+}
+
+func localObjectAttrs(name string, info fs.FileInfo) *ObjectAttrs {
+	return &ObjectAttrs{
+		Name:        name,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(name)),
+		Created:     info.ModTime(),
+	}
+}
+
+// memoryStore is an in-memory ObjectStore, useful for dry runs and tests
+type memoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	attrs ObjectAttrs
+	data  []byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: make(map[string]*memoryObject)}
+}
+
+func (s *memoryStore) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, ErrObjectNotExist
+	}
+	attrs := obj.attrs
+	return &attrs, nil
+}
+
+func (s *memoryStore) Write(ctx context.Context, name string, r io.Reader, opts WriteOptions) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = &memoryObject{
+		attrs: ObjectAttrs{
+			Name:         name,
+			Size:         int64(len(data)),
+			ContentType:  opts.ContentType,
+			CacheControl: opts.CacheControl,
+			Created:      time.Now(),
+		},
+		data: data,
+	}
+	return nil
+}
+
+func (s *memoryStore) Read(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, ErrObjectNotExist
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (s *memoryStore) List(ctx context.Context, prefix string) ([]ObjectAttrs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectAttrs
+	for name, obj := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, obj.attrs)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return ErrObjectNotExist
+	}
+	delete(s.objects, name)
+	return nil
+}
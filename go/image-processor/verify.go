@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+)
+
+// VerifyReport lists the drift found between the cache and the object store
+type VerifyReport struct {
+	Entries int
+	Objects int
+
+	// MissingVariants maps a cache filename to the variant paths absent from the store
+	MissingVariants map[string][]string
+	// Unreferenced are objects no cache entry points at
+	Unreferenced []string
+	// ZeroByte are empty objects
+	ZeroByte []string
+	// ContentTypeMismatches maps an object path to a description of the mismatch
+	ContentTypeMismatches map[string]string
+}
+
+// HasDrift returns true if any problem was found
+func (r *VerifyReport) HasDrift() bool {
+	return len(r.MissingVariants) > 0 ||
+		len(r.Unreferenced) > 0 ||
+		len(r.ZeroByte) > 0 ||
+		len(r.ContentTypeMismatches) > 0
+}
+
+// Problems returns the total number of problems found
+func (r *VerifyReport) Problems() int {
+	missing := 0
+	for _, paths := range r.MissingVariants {
+		missing += len(paths)
+	}
+	return missing + len(r.Unreferenced) + len(r.ZeroByte) + len(r.ContentTypeMismatches)
+}
+
+// legacySuffixes are the variants uploaded before paths were recorded: the
+// three fixed widths and the full-size JPEG
+var legacySuffixes = []string{"_0", "_1", "_2", ""}
+
+// expectedPaths returns the variant paths a cache entry should have in the store.
+// Legacy entries have no recorded paths, so only the variants every image had
+// back then are expected, not rungs added to the ladder since.
+func expectedPaths(entry *CacheEntry) []string {
+	if len(entry.GCSPaths) > 0 {
+		return entry.GCSPaths
+	}
+	paths := make([]string, 0, len(legacySuffixes))
+	for _, suffix := range legacySuffixes {
+		paths = append(paths, variantObjectPath(entry.ObjectID(), &Rung{Suffix: suffix}, jpegFormat))
+	}
+	return paths
+}
+
+// buildVerifyReport compares every cache entry against the objects under the image prefix
+func buildVerifyReport(ctx context.Context, store ObjectStore, cache *ImageCache) (*VerifyReport, error) {
+	objects, err := store.List(ctx, gcsImagePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	entries := cache.Entries()
+	report := &VerifyReport{
+		Entries:               len(entries),
+		Objects:               len(objects),
+		MissingVariants:       make(map[string][]string),
+		ContentTypeMismatches: make(map[string]string),
+	}
+
+	stored := make(map[string]ObjectAttrs, len(objects))
+	for _, attrs := range objects {
+		stored[attrs.Name] = attrs
+	}
+
+	referenced := make(map[string]bool)
+	for _, entry := range entries {
+		for _, objectPath := range expectedPaths(entry) {
+			referenced[objectPath] = true
+			if _, ok := stored[objectPath]; !ok {
+				report.MissingVariants[entry.Filename] = append(report.MissingVariants[entry.Filename], objectPath)
+			}
+		}
+	}
+
+	for _, attrs := range objects {
+		if !referenced[attrs.Name] {
+			report.Unreferenced = append(report.Unreferenced, attrs.Name)
+		}
+
+		if attrs.Size == 0 {
+			report.ZeroByte = append(report.ZeroByte, attrs.Name)
+		}
+
+		if format := formatByExtension(path.Ext(attrs.Name)); format != nil && attrs.ContentType != format.ContentType {
+			report.ContentTypeMismatches[attrs.Name] = fmt.Sprintf("got %q, want %q", attrs.ContentType, format.ContentType)
+		}
+	}
+
+	return report, nil
+}
+
+// Print logs a summary of the report and a record per problem found
+func (r *VerifyReport) Print() {
+	slog.Info("verification summary",
+		"entries", r.Entries,
+		"objects", r.Objects,
+		"entries_with_missing", len(r.MissingVariants),
+		"unreferenced", len(r.Unreferenced),
+		"zero_byte", len(r.ZeroByte),
+		"content_type_mismatches", len(r.ContentTypeMismatches),
+	)
+
+	for _, filename := range sortedKeys(r.MissingVariants) {
+		for _, objectPath := range r.MissingVariants[filename] {
+			slog.Warn("missing variant", "filename", filename, "variant", objectPath)
+		}
+	}
+	for _, objectPath := range r.Unreferenced {
+		slog.Warn("unreferenced object", "variant", objectPath)
+	}
+	for _, objectPath := range r.ZeroByte {
+		slog.Warn("zero-byte object", "variant", objectPath)
+	}
+	for _, objectPath := range sortedKeys(r.ContentTypeMismatches) {
+		slog.Warn("content-type mismatch", "variant", objectPath, "detail", r.ContentTypeMismatches[objectPath])
+	}
+}
+
+func verifyCacheIntegrity(ctx context.Context, store ObjectStore, cache *ImageCache) error {
+	slog.Info("verifying cache integrity")
+
+	report, err := buildVerifyReport(ctx, store, cache)
+	if err != nil {
+		return err
+	}
+
+	report.Print()
+
+	if report.HasDrift() {
+		return fmt.Errorf("found %d problems", report.Problems())
+	}
+
+	slog.Info("verification complete, cache and store are in sync")
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
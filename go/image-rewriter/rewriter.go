@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/devhou-se/www-jp/go/utils"
+)
+
+// Config holds rewriter configuration
+type Config struct {
+	CachePath string
+	MaxWidth  int
+	DryRun    bool
+	Verbose   bool
+}
+
+// cachedImage is the subset of an image processor cache entry the rewriter needs
+type cachedImage struct {
+	ID     string
+	Width  int
+	Height int
+}
+
+func main() {
+	config := parseFlags()
+
+	level := slog.LevelInfo
+	if config.Verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+
+	cache, err := loadCache(config.CachePath)
+	if err != nil {
+		slog.Error("failed to load cache", "path", config.CachePath, "error", err)
+		os.Exit(1)
+	}
+
+	images, err := utils.WebImages()
+	if err != nil {
+		slog.Error("failed to find images", "error", err)
+		os.Exit(1)
+	}
+
+	// Group replacements by file so each post is read and written once
+	replacements := make(map[string][]replacement)
+	var files []string
+	skipped := 0
+
+	for _, img := range images {
+		if !isGitHubAsset(img.WebLocation) {
+			continue
+		}
+
+		// Content-addressed caches are keyed by URL, name-based ones by filename
+		entry, ok := cache[img.WebLocation]
+		if !ok {
+			entry, ok = cache[utils.ImageFilename(img.WebLocation)]
+		}
+		if !ok || entry.Width == 0 || entry.Height == 0 {
+			slog.Debug("not processed yet, skipping", "url", img.WebLocation, "file", img.InFile)
+			skipped++
+			continue
+		}
+
+		if _, ok := replacements[img.InFile]; !ok {
+			files = append(files, img.InFile)
+		}
+		replacements[img.InFile] = append(replacements[img.InFile], replacement{
+			old: img.FullMarkdown,
+			new: shortcode(entry, config.MaxWidth),
+		})
+	}
+
+	rewritten := 0
+	for _, file := range files {
+		changed, err := rewriteFile(file, replacements[file], config.DryRun)
+		if err != nil {
+			slog.Error("failed to rewrite file", "file", file, "error", err)
+			os.Exit(1)
+		}
+		rewritten += changed
+	}
+
+	message := "rewrote images"
+	if config.DryRun {
+		message = "would rewrite images"
+	}
+	slog.Info(message, "images", rewritten, "files", len(files), "not_processed", skipped)
+}
+
+func parseFlags() *Config {
+	config := &Config{}
+
+	flag.StringVar(&config.CachePath, "cache", utils.CacheFilePath, "Path to the image processor cache")
+	flag.IntVar(&config.MaxWidth, "max-width", 960, "Maximum display width written to the shortcode (0 for the original width)")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Print a diff instead of rewriting files")
+	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose logging")
+
+	flag.Parse()
+	return config
+}
+
+type replacement struct {
+	old string
+	new string
+}
+
+// rewriteFile applies replacements to a markdown file, or prints them as a diff
+// in dry-run mode. It returns the number of image links replaced.
+func rewriteFile(file string, replacements []replacement, dryRun bool) (int, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	content := string(data)
+	count := 0
+	for _, r := range replacements {
+		if !strings.Contains(content, r.old) {
+			continue
+		}
+		count += strings.Count(content, r.old)
+		content = strings.ReplaceAll(content, r.old, r.new)
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	if dryRun {
+		printDiff(file, string(data), content)
+		return count, nil
+	}
+
+	return count, os.WriteFile(file, []byte(content), info.Mode())
+}
+
+// printDiff prints the changed lines between two versions of a file
+func printDiff(file, before, after string) {
+	oldLines := strings.Split(before, "\n")
+	newLines := strings.Split(after, "\n")
+
+	fmt.Printf("--- %s\n+++ %s\n", file, file)
+	// Replacements never add or remove lines, so lines can be compared pairwise
+	for i := range oldLines {
+		if i < len(newLines) && oldLines[i] != newLines[i] {
+			fmt.Printf("@@ line %d @@\n-%s\n+%s\n", i+1, oldLines[i], newLines[i])
+		}
+	}
+}
+
+// shortcode builds the lazyimage shortcode for a cached image, scaling the
+// display size down to maxWidth while keeping the aspect ratio
+func shortcode(entry cachedImage, maxWidth int) string {
+	width, height := entry.Width, entry.Height
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	return fmt.Sprintf("{{< lazyimage %s %d %d >}}", entry.ID, width, height)
+}
+
+// isGitHubAsset reports whether a URL points at an image uploaded to GitHub
+func isGitHubAsset(url string) bool {
+	return strings.HasPrefix(url, "https://github.com/") && strings.Contains(url, "/assets/")
+}
+
+// loadCache reads the image processor cache. Legacy entries, without
+// dimensions, are left out.
+func loadCache(path string) (map[string]cachedImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cache := make(map[string]cachedImage)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parsed, err := utils.ParseCacheLine(line)
+		if err != nil {
+			continue
+		}
+		cache[parsed.Filename] = cachedImage{
+			ID:     objectID(parsed.Filename, parsed.Paths),
+			Width:  parsed.Width,
+			Height: parsed.Height,
+		}
+	}
+
+	return cache, scanner.Err()
+}
+
+// objectID returns the ID an entry's variants are named after. The full-size
+// JPEG has no rung suffix, so it is the JPEG path with the shortest name.
+// Legacy entries without paths are named after the filename.
+func objectID(filename string, paths []string) string {
+	id := ""
+	for _, objectPath := range paths {
+		if path.Ext(objectPath) != ".jpeg" {
+			continue
+		}
+		base := strings.TrimSuffix(path.Base(objectPath), ".jpeg")
+		if id == "" || len(base) < len(id) {
+			id = base
+		}
+	}
+	if id == "" {
+		return utils.ImageID(filename)
+	}
+	return id
+}
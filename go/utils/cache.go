@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	CacheFilePath = "imager-cache.txt"
+	CacheFormat   = "filename|hash|timestamp|width|height|key=value...|gcs_path..."
+)
+
+// CacheLine is one entry of the image processor cache
+type CacheLine struct {
+	Filename  string
+	Hash      string
+	Timestamp int64
+	Width     int
+	Height    int
+
+	// Attributes are the optional key=value fields (v2.1)
+	Attributes map[string]string
+	Paths      []string
+}
+
+// ParseCacheLine parses a v2.0 or v2.1 cache line in CacheFormat. v2.0 lines
+// have no key=value fields; object paths never contain "=" so the two can be
+// told apart. v1.0 lines, a bare filename, are an error.
+func ParseCacheLine(line string) (*CacheLine, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < 5 {
+		return nil, fmt.Errorf("invalid format: expected at least 5 fields, got %d", len(parts))
+	}
+
+	timestamp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %w", err)
+	}
+
+	width, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid width: %w", err)
+	}
+
+	height, err := strconv.Atoi(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid height: %w", err)
+	}
+
+	parsed := &CacheLine{
+		Filename:   parts[0],
+		Hash:       parts[1],
+		Timestamp:  timestamp,
+		Width:      width,
+		Height:     height,
+		Attributes: make(map[string]string),
+		Paths:      []string{},
+	}
+
+	for _, field := range parts[5:] {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			parsed.Attributes[key] = value
+			continue
+		}
+		parsed.Paths = append(parsed.Paths, field)
+	}
+
+	return parsed, nil
+}
@@ -11,7 +11,8 @@ const (
 )
 
 var (
-	MarkdownImageR = regexp.MustCompile("!\\[([^]]*)]\\(((https?://[^)]*)|([^)]*))\\)") // 1: alt 2: location 3: web location 4: local location
+	MarkdownImageR = regexp.MustCompile("!\\[([^]]*)]\\(((https?://[^)]*)|([^)]*))\\)")                // 1: alt 2: location 3: web location 4: local location
+	LazyImageR     = regexp.MustCompile(`{{<\s*lazyimage\s+([^\s>]+)(?:\s+(\d+))?(?:\s+(\d+))?\s*>}}`) // 1: id 2: width 3: height
 )
 
 // Image represents the data that can be found in a markdown image tag
@@ -25,6 +26,16 @@ type Image struct {
 	InFile       string
 }
 
+// LazyImage represents the data that can be found in a lazyimage shortcode
+type LazyImage struct {
+	ID     string
+	Width  string
+	Height string
+
+	FullShortcode string
+	InFile        string
+}
+
 // Images finds all images an all content markdown files
 func Images() ([]Image, error) {
 	markdowns, err := Markdowns()
@@ -73,6 +84,58 @@ func LocalImages() ([]Image, error) {
 	}), nil
 }
 
+// LazyImages finds all lazyimage shortcodes on all content markdown files
+func LazyImages() ([]LazyImage, error) {
+	markdowns, err := Markdowns()
+	if err != nil {
+		return nil, err
+	}
+	var images []LazyImage
+	for _, markdown := range markdowns {
+		fileBytes, err := os.ReadFile(markdown)
+		if err != nil {
+			return nil, err
+		}
+		for _, findings := range LazyImageR.FindAllStringSubmatch(string(fileBytes), -1) {
+			images = append(images, LazyImage{
+				ID:            findings[1],
+				Width:         findings[2],
+				Height:        findings[3],
+				FullShortcode: findings[0],
+				InFile:        markdown,
+			})
+		}
+	}
+	return images, nil
+}
+
+// ImageFilename returns the filename an image is stored under, derived from the
+// last path segment of its URL. GitHub asset URLs have no extension, so .jpeg is added.
+func ImageFilename(url string) string {
+	parts := strings.Split(url, "/")
+	filename := parts[len(parts)-1]
+
+	// Remove query parameters if present
+	if idx := strings.Index(filename, "?"); idx != -1 {
+		filename = filename[:idx]
+	}
+
+	// Ensure .jpeg extension for GitHub asset URLs
+	if !strings.HasSuffix(filename, ".jpeg") && !strings.HasSuffix(filename, ".jpg") && !strings.HasSuffix(filename, ".png") {
+		filename = filename + ".jpeg"
+	}
+
+	return filename
+}
+
+// ImageID strips the source extension from an image filename, giving the ID
+// used by the lazyimage shortcode and in variant object names
+func ImageID(filename string) string {
+	id := strings.TrimSuffix(filename, ".jpeg")
+	id = strings.TrimSuffix(id, ".jpg")
+	return strings.TrimSuffix(id, ".png")
+}
+
 func HTMLs() ([]string, error) {
 	files, err := FlatFiles(SiteDirectory)
 	return FilterFiletype(files, "html"), err
@@ -1,6 +1,7 @@
 from enum import Enum
 
 import datetime
+import json
 import os
 import re
 import yaml
@@ -10,7 +11,7 @@ MAX_AGE = 2  # days
 GALLERY_HTML = os.path.join(os.getcwd(), "site", "themes", "devhouse-theme", "layouts", "partials", "gallery.html")
 IMAGES_HTML = os.path.join(os.getcwd(), "site", "content", "gallery.md")
 IMG_PATTERN = r"(\!\[(.*)\]\((.*)\))"
-LAZYIMAGE_PATTERN = r"\{\{<\s*lazyimage\s+([a-f0-9-]+)\s+\d+\s*>\}\}"
+LAZYIMAGE_PATTERN = r"\{\{<\s*lazyimage\s+([a-f0-9-]+)(?:\s+\d+){0,2}\s*>\}\}"
 
 def get_image_id(src: str) -> str:
     """Extract image ID from GitHub URL or local path."""
@@ -25,16 +26,14 @@ def get_image_id(src: str) -> str:
     else:
         return None
 
-IMG_TEMPLATE = r"<a href=\"/{}\"><img id=\"sidebar-img-{}\" alt=\"{}\" /></a><script>loadImageInStages(document.getElementById('sidebar-img-{}'), 'https://storage.googleapis.com/static.devh.se/images/{}_0.jpeg', 'https://storage.googleapis.com/static.devh.se/images/{}_1.jpeg', 'https://storage.googleapis.com/static.devh.se/images/{}_2.jpeg', 'https://storage.googleapis.com/static.devh.se/images/{}.jpeg');<\/script>"
+# The image data only exists at build time, so the daily-image partial looks
+# up which rungs each choice has when Hugo renders it
+IMG_TEMPLATE = '{{{{- $choices = $choices | append (dict "post" {} "id" {} "alt" {}) -}}}}'
 IMG_MD_TEMPLATE = "![{}]({})"
 IMG_MD_LINK_TEMPLATE = "[![{}]({})](/{})"
-HTML_TEMPLATE = """<span id="daily-image"></span>
-<script>
-const choices = {choices};
-const choice = choices[Math.floor(Math.random() * choices.length)];
-const imgSpan = document.getElementById("daily-image");
-imgSpan.innerHTML = choice;
-</script>
+HTML_TEMPLATE = """{{{{- $choices := slice -}}}}
+{choices}
+{{{{- partial "daily-image.html" $choices -}}}}
 """
 HTML_PAGE_TEMPLATE = """---
 type: gallery
@@ -94,14 +93,14 @@ def main():
             alt = img[0][1]
             img_id = get_image_id(img[0][2])
             if img_id:
-                # Sanitize ID to prevent Hugo from parsing as scientific notation
-                # Replace hyphens with underscores in HTML IDs
-                safe_id = img_id.replace('-', '_')
-                # Format: post_num, safe_id (for element id), alt, safe_id (for getElementById), img_id (4 times for URLs)
-                formatted_images.append(IMG_TEMPLATE.format(post_num, safe_id, alt, safe_id, img_id, img_id, img_id, img_id))
-
-        images = "['" + "', '".join(formatted_images) + "']"
-        js = HTML_TEMPLATE.format(choices=images)
+                # JSON strings are valid Go template string literals, so
+                # quotes in the alt text can't break out of them. Non-ASCII is
+                # written as is: Go rejects the surrogate pair escapes JSON
+                # uses for characters outside the BMP, such as emoji
+                values = (json.dumps(v, ensure_ascii=False) for v in (post_num, img_id, alt))
+                formatted_images.append(IMG_TEMPLATE.format(*values))
+
+        js = HTML_TEMPLATE.format(choices="\n".join(formatted_images))
 
         with open(GALLERY_HTML, "w") as f:
             f.write(js)
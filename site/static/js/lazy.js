@@ -1,12 +1,37 @@
-function loadImageInStages(imageElement, a, b, c, d) {
-    const loadNextSrc = (src, nextSrcCallback) => {
-        const img = new Image();
-        img.src = src;
-        img.onload = () => {
-            imageElement.src = src;
-            if (nextSrcCallback) nextSrcCallback();
+// Each source is a URL, or several space-separated URLs of the same size in
+// order of preference (e.g. AVIF, WebP, JPEG). A format the browser can't
+// decode fails to load, so the next URL is tried and that format is skipped
+// for the later stages. A stage none of whose URLs load (e.g. a rung that was
+// skipped for a small original) is passed over for the next one.
+//
+// Returns a promise of the URL finally shown, undefined if none loaded.
+function loadImageInStages(imageElement, ...sources) {
+    const skipped = new Set();
+    const extension = (url) => url.split('?')[0].split('.').pop();
+
+    return new Promise((resolve) => {
+        let shown;
+        const loadNextSrc = (index, candidate = 0) => {
+            if (index >= sources.length) {
+                resolve(shown);
+                return;
+            }
+            const urls = sources[index].split(' ').filter((url) => url && !skipped.has(extension(url)));
+            if (candidate >= urls.length) {
+                loadNextSrc(index + 1);
+                return;
+            }
+            const img = new Image();
+            img.onload = () => {
+                shown = urls[candidate];
+                imageElement.src = shown;
+                urls.slice(0, candidate).forEach((url) => skipped.add(extension(url)));
+                loadNextSrc(index + 1);
+            };
+            img.onerror = () => loadNextSrc(index, candidate + 1);
+            img.src = urls[candidate];
         };
-    };
 
-    loadNextSrc(a, () => loadNextSrc(b, () => loadNextSrc(c, () => loadNextSrc(d))));
+        loadNextSrc(0);
+    });
 }